@@ -1,6 +1,7 @@
 -- Create databases
 CREATE DATABASE orders;
 CREATE DATABASE sales;
+CREATE DATABASE orchestrator;
 
 -- Connect to orders database
 \c orders;
@@ -9,16 +10,24 @@ CREATE DATABASE sales;
 CREATE TABLE products (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    price DECIMAL(10,2) NOT NULL,
-    stock_quantity INTEGER NOT NULL DEFAULT 0,
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    price DECIMAL(10,2) NOT NULL CHECK (price >= 0),
+    stock_quantity INTEGER NOT NULL DEFAULT 0 CHECK (stock_quantity >= 0),
+    reserved_quantity INTEGER NOT NULL DEFAULT 0 CHECK (reserved_quantity >= 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    deleted_at TIMESTAMP
 );
 
 CREATE TABLE orders (
     id SERIAL PRIMARY KEY,
     customer_id INTEGER NOT NULL,
     total_amount DECIMAL(10,2) NOT NULL,
-    status VARCHAR(50) DEFAULT 'pending',
+    status VARCHAR(50) DEFAULT 'pending'
+        CHECK (status IN ('pending', 'confirmed', 'completed', 'cancelled', 'refunded')),
+    -- Choreography saga progress; orders awaiting payment past saga_deadline are cancelled
+    saga_step VARCHAR(50) NOT NULL DEFAULT 'awaiting_payment'
+        CHECK (saga_step IN ('awaiting_payment', 'confirmed', 'cancelled', 'timed_out')),
+    saga_deadline TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -30,6 +39,49 @@ CREATE TABLE order_items (
     price DECIMAL(10,2) NOT NULL
 );
 
+-- Indexes for GET /orders filters and keyset pagination
+CREATE INDEX idx_orders_created_at ON orders(created_at, id);
+CREATE INDEX idx_orders_total_amount ON orders(total_amount, id);
+CREATE INDEX idx_orders_customer_created_at ON orders(customer_id, created_at, id);
+CREATE INDEX idx_orders_status_created_at ON orders(status, created_at, id);
+CREATE INDEX idx_order_items_order_id ON order_items(order_id);
+CREATE INDEX idx_orders_saga_deadline ON orders(saga_deadline) WHERE saga_step = 'awaiting_payment';
+
+CREATE TABLE order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id),
+    from_status VARCHAR(50) NOT NULL,
+    to_status VARCHAR(50) NOT NULL,
+    changed_by VARCHAR(100) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_status_history_order_id ON order_status_history(order_id);
+
+-- Stock held for pending orders until they are confirmed, cancelled or the hold expires
+CREATE TABLE reservations (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id),
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'held' CHECK (status IN ('held', 'committed', 'released')),
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_reservations_order_id ON reservations(order_id);
+CREATE INDEX idx_reservations_held_expires_at ON reservations(expires_at) WHERE status = 'held';
+
+CREATE TABLE idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64) NOT NULL,
+    status_code INTEGER NOT NULL,
+    response JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Outbox table for orders service
 CREATE TABLE outbox_events (
     id SERIAL PRIMARY KEY,
@@ -37,8 +89,52 @@ CREATE TABLE outbox_events (
     event_type VARCHAR(100) NOT NULL,
     aggregate_id INTEGER NOT NULL,
     event_data JSONB NOT NULL,
+    data_version INTEGER NOT NULL DEFAULT 1,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    processed BOOLEAN DEFAULT FALSE
+    processed BOOLEAN DEFAULT FALSE,
+    processed_at TIMESTAMP,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP,
+    locked_by VARCHAR(255),
+    locked_until TIMESTAMP
+);
+
+CREATE INDEX idx_outbox_events_unprocessed ON outbox_events(id) WHERE processed = false;
+
+-- Outbox events that ran out of publish attempts, kept for inspection and re-drive
+CREATE TABLE outbox_dead_letters (
+    id SERIAL PRIMARY KEY,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    aggregate_id INTEGER NOT NULL,
+    event_data JSONB NOT NULL,
+    data_version INTEGER NOT NULL DEFAULT 1,
+    attempts INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    dead_lettered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    redriven_at TIMESTAMP
+);
+
+-- Saga events already applied by this service, written in the same transaction as their state change
+CREATE TABLE inbox_events (
+    event_id VARCHAR(255) PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    order_id INTEGER NOT NULL,
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    duplicate_count INTEGER NOT NULL DEFAULT 0,
+    last_duplicate_at TIMESTAMP
+);
+
+-- Consumed saga messages that could not be decoded or handled, kept with their raw payload
+CREATE TABLE quarantined_messages (
+    id SERIAL PRIMARY KEY,
+    message_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(100) NOT NULL,
+    payload TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    quarantined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 -- Insert sample products
@@ -69,6 +165,9 @@ CREATE TABLE sales_transactions (
     discount_amount DECIMAL(10,2) DEFAULT 0,
     final_amount DECIMAL(10,2) NOT NULL,
     status VARCHAR(50) DEFAULT 'pending',
+    voided_at TIMESTAMP,
+    void_reason TEXT,
+    idempotency_key VARCHAR(255) UNIQUE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -87,4 +186,45 @@ CREATE TABLE outbox_events (
 INSERT INTO vouchers (code, discount_percent, max_discount) VALUES 
 ('SAVE10', 10.00, 100.00),
 ('SAVE20', 20.00, 200.00),
-('WELCOME', 15.00, 50.00);
\ No newline at end of file
+('WELCOME', 15.00, 50.00);
+
+-- Connect to orchestrator database
+\c orchestrator;
+
+-- Orchestrator workflow state
+CREATE TABLE workflows (
+    id VARCHAR(64) PRIMARY KEY,
+    saga VARCHAR(100) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    request JSONB NOT NULL,
+    response JSONB NOT NULL DEFAULT '{}',
+    recovery JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE workflow_steps (
+    id SERIAL PRIMARY KEY,
+    workflow_id VARCHAR(64) NOT NULL REFERENCES workflows(id),
+    position INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    response JSONB,
+    error TEXT,
+    compensation JSONB,
+    idempotency_key VARCHAR(255),
+    attempts JSONB NOT NULL DEFAULT '[]',
+    compensation_attempts JSONB NOT NULL DEFAULT '[]',
+    UNIQUE (workflow_id, position)
+);
+
+CREATE INDEX idx_workflows_status ON workflows(status);
+
+CREATE TABLE idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64) NOT NULL,
+    status_code INTEGER NOT NULL,
+    response JSONB NOT NULL,
+    workflow_id VARCHAR(64) NOT NULL REFERENCES workflows(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects calls until the open timeout has passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single trial call through; its outcome closes or reopens the circuit
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// CircuitOpenError is returned instead of calling a service whose circuit is open
+type CircuitOpenError struct {
+	Service    string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit for %s service is open, retry after %s", e.Service, e.RetryAfter)
+}
+
+// RetryAfterSeconds is the value of a Retry-After header for the error, rounded up to a whole second
+func (e *CircuitOpenError) RetryAfterSeconds() string {
+	return strconv.Itoa(int((e.RetryAfter + time.Second - 1) / time.Second))
+}
+
+// CircuitBreaker stops calls to a downstream service after FailureThreshold consecutive failures
+// and tries again once OpenTimeout has passed
+type CircuitBreaker struct {
+	Service          string
+	FailureThreshold int
+	OpenTimeout      time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the trial call of a half-open circuit is in flight
+	probing bool
+	// admittedAt is when Admit let a new orchestration through a half-open circuit; the trial call is left
+	// to it until it makes one, its Admission is released or OpenTimeout passes
+	admittedAt time.Time
+}
+
+// BreakerStatus is a point-in-time view of a circuit breaker
+type BreakerStatus struct {
+	Service             string       `json:"service"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	RetryAfterSeconds   int          `json:"retry_after_seconds,omitempty"`
+}
+
+func NewCircuitBreaker(service string, failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Service:          service,
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      openTimeout,
+		state:            BreakerClosed,
+	}
+}
+
+// currentState moves an open circuit to half-open once its timeout has passed. b.mu must be held.
+func (b *CircuitBreaker) currentState(now time.Time) BreakerState {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.OpenTimeout {
+		b.state = BreakerHalfOpen
+		b.probing = false
+		b.admittedAt = time.Time{}
+	}
+	return b.state
+}
+
+// rejection returns the error for a call made now, or nil if it may go through. b.mu must be held.
+func (b *CircuitBreaker) rejection(now time.Time) error {
+	switch b.currentState(now) {
+	case BreakerOpen:
+		return &CircuitOpenError{Service: b.Service, RetryAfter: b.openedAt.Add(b.OpenTimeout).Sub(now)}
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{Service: b.Service, RetryAfter: time.Second}
+		}
+	}
+	return nil
+}
+
+// Allow is called before every guarded call and must be followed by Record with its outcome
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.rejection(time.Now()); err != nil {
+		return err
+	}
+	if b.state == BreakerHalfOpen {
+		b.probing = true
+		b.admittedAt = time.Time{}
+	}
+	return nil
+}
+
+// Admission is a new orchestration's hold on the half-open trial slots of the breakers that admitted it
+type Admission struct {
+	breakers []*CircuitBreaker
+	at       time.Time
+}
+
+// Admit decides whether a new orchestration that depends on every one of breakers may start. While a circuit
+// is half-open only one is admitted, and it gets the trial call; the others would only fail and compensate.
+// The breakers are decided together under all their locks, so a rejection by one takes no slot from another.
+func Admit(breakers ...*CircuitBreaker) (*Admission, error) {
+	for _, b := range breakers {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+	}
+
+	now := time.Now()
+	for _, b := range breakers {
+		if err := b.rejection(now); err != nil {
+			return nil, err
+		}
+		if b.state == BreakerHalfOpen && !b.admittedAt.IsZero() && now.Sub(b.admittedAt) < b.OpenTimeout {
+			return nil, &CircuitOpenError{Service: b.Service, RetryAfter: time.Second}
+		}
+	}
+
+	admission := &Admission{at: now}
+	for _, b := range breakers {
+		if b.state == BreakerHalfOpen {
+			b.admittedAt = now
+			admission.breakers = append(admission.breakers, b)
+		}
+	}
+	return admission, nil
+}
+
+// Release gives back the trial slots of an admitted orchestration that did not start
+func (a *Admission) Release() {
+	for _, b := range a.breakers {
+		b.mu.Lock()
+		if b.admittedAt.Equal(a.at) {
+			b.admittedAt = time.Time{}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Record counts the outcome of a call; a failure of the half-open trial or the last allowed failure opens the circuit
+func (b *CircuitBreaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	state := b.currentState(now)
+	if !failed {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.probing = false
+		b.admittedAt = time.Time{}
+		return
+	}
+
+	b.failures++
+	if state == BreakerHalfOpen || (state == BreakerClosed && b.failures >= b.FailureThreshold) {
+		b.state = BreakerOpen
+		b.openedAt = now
+		b.probing = false
+	}
+}
+
+// Abandon is Record for a call that ended without an outcome; it frees the half-open trial slot
+func (b *CircuitBreaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	status := BreakerStatus{Service: b.Service, State: b.currentState(now), ConsecutiveFailures: b.failures}
+	if status.State != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if status.State == BreakerOpen {
+		status.RetryAfterSeconds = int((b.openedAt.Add(b.OpenTimeout).Sub(now) + time.Second - 1) / time.Second)
+	}
+	return status
+}
+
+var (
+	orderServiceBreaker *CircuitBreaker
+	salesServiceBreaker *CircuitBreaker
+)
+
+// initBreakers creates one breaker per downstream service from CIRCUIT_FAILURE_THRESHOLD and CIRCUIT_OPEN_TIMEOUT
+func initBreakers() {
+	threshold, err := strconv.Atoi(getEnv("CIRCUIT_FAILURE_THRESHOLD", "5"))
+	if err != nil || threshold < 1 {
+		threshold = 5
+	}
+	openTimeout, err := time.ParseDuration(getEnv("CIRCUIT_OPEN_TIMEOUT", "30s"))
+	if err != nil || openTimeout <= 0 {
+		openTimeout = 30 * time.Second
+	}
+
+	orderServiceBreaker = NewCircuitBreaker("order", threshold, openTimeout)
+	salesServiceBreaker = NewCircuitBreaker("sales", threshold, openTimeout)
+}
+
+// downstreamBreakers lists the breakers a new order orchestration depends on
+func downstreamBreakers() []*CircuitBreaker {
+	return []*CircuitBreaker{orderServiceBreaker, salesServiceBreaker}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// openBreaker returns a breaker with a threshold of 3 that has just opened
+func openBreaker(t *testing.T) *CircuitBreaker {
+	b := NewCircuitBreaker("order", 3, time.Minute)
+	for i := 0; i < 3; i++ {
+		b.Record(true)
+	}
+	if state := b.Status().State; state != BreakerOpen {
+		t.Fatalf("breaker is %s after 3 failures, want open", state)
+	}
+	return b
+}
+
+// halfOpenBreaker returns a breaker whose open timeout has just passed
+func halfOpenBreaker(t *testing.T) *CircuitBreaker {
+	b := openBreaker(t)
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-b.OpenTimeout)
+	b.mu.Unlock()
+
+	if state := b.Status().State; state != BreakerHalfOpen {
+		t.Fatalf("breaker is %s after its open timeout, want half_open", state)
+	}
+	return b
+}
+
+func isCircuitOpen(err error) bool {
+	var openErr *CircuitOpenError
+	return errors.As(err, &openErr)
+}
+
+func TestBreakerOpensAtThreshold(t *testing.T) {
+	b := NewCircuitBreaker("order", 3, time.Minute)
+	b.Record(true)
+	b.Record(true)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after 2 of 3 failures: %v", err)
+	}
+
+	// A success resets the count
+	b.Record(false)
+	b.Record(true)
+	b.Record(true)
+	if state := b.Status().State; state != BreakerClosed {
+		t.Fatalf("breaker is %s after a success and 2 failures, want closed", state)
+	}
+
+	b.Record(true)
+	status := b.Status()
+	if status.State != BreakerOpen || status.RetryAfterSeconds != 60 {
+		t.Fatalf("status is %+v, want open with a retry after 60 seconds", status)
+	}
+	if err := b.Allow(); !isCircuitOpen(err) {
+		t.Fatalf("Allow on an open circuit returned %v, want a CircuitOpenError", err)
+	}
+	if _, err := Admit(b); !isCircuitOpen(err) {
+		t.Fatalf("Admit on an open circuit returned %v, want a CircuitOpenError", err)
+	}
+}
+
+func TestBreakerHalfOpensAfterTimeout(t *testing.T) {
+	b := halfOpenBreaker(t)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow of the trial call: %v", err)
+	}
+	if err := b.Allow(); !isCircuitOpen(err) {
+		t.Fatalf("Allow while the trial call is in flight returned %v, want a CircuitOpenError", err)
+	}
+}
+
+func TestBreakerAdmitsSingleOrchestrationWhileHalfOpen(t *testing.T) {
+	b := halfOpenBreaker(t)
+	other := NewCircuitBreaker("sales", 3, time.Minute)
+
+	if _, err := Admit(b, other); err != nil {
+		t.Fatalf("first Admit: %v", err)
+	}
+	if _, err := Admit(b, other); !isCircuitOpen(err) {
+		t.Fatalf("second Admit returned %v, want a CircuitOpenError", err)
+	}
+
+	// The admitted orchestration makes the trial call, after which admission waits for its outcome
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow of the trial call: %v", err)
+	}
+	if _, err := Admit(b, other); !isCircuitOpen(err) {
+		t.Fatalf("Admit during the trial call returned %v, want a CircuitOpenError", err)
+	}
+}
+
+func TestBreakerAdmitTakesNoSlotWhenAnotherBreakerRejects(t *testing.T) {
+	b := halfOpenBreaker(t)
+	open := openBreaker(t)
+
+	if _, err := Admit(b, open); !isCircuitOpen(err) {
+		t.Fatalf("Admit with an open breaker returned %v, want a CircuitOpenError", err)
+	}
+	if _, err := Admit(b); err != nil {
+		t.Fatalf("Admit after a rejected admission: %v", err)
+	}
+}
+
+func TestBreakerReleasedAdmissionFreesSlot(t *testing.T) {
+	b := halfOpenBreaker(t)
+
+	admission, err := Admit(b)
+	if err != nil {
+		t.Fatalf("Admit: %v", err)
+	}
+	admission.Release()
+	if _, err := Admit(b); err != nil {
+		t.Fatalf("Admit after Release: %v", err)
+	}
+}
+
+func TestBreakerTrialSuccessCloses(t *testing.T) {
+	b := halfOpenBreaker(t)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	b.Record(false)
+
+	status := b.Status()
+	if status.State != BreakerClosed || status.ConsecutiveFailures != 0 {
+		t.Fatalf("status after a successful trial is %+v, want closed with no failures", status)
+	}
+	if _, err := Admit(b); err != nil {
+		t.Fatalf("Admit on a closed circuit: %v", err)
+	}
+	if _, err := Admit(b); err != nil {
+		t.Fatalf("second Admit on a closed circuit: %v", err)
+	}
+}
+
+func TestBreakerTrialFailureReopens(t *testing.T) {
+	b := halfOpenBreaker(t)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	b.Record(true)
+
+	if state := b.Status().State; state != BreakerOpen {
+		t.Fatalf("breaker is %s after a failed trial, want open", state)
+	}
+	if err := b.Allow(); !isCircuitOpen(err) {
+		t.Fatalf("Allow after a failed trial returned %v, want a CircuitOpenError", err)
+	}
+}
+
+func TestBreakerAbandonFreesTrial(t *testing.T) {
+	b := halfOpenBreaker(t)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	b.Abandon()
+
+	if state := b.Status().State; state != BreakerHalfOpen {
+		t.Fatalf("breaker is %s after an abandoned trial, want half_open", state)
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after an abandoned trial: %v", err)
+	}
+}
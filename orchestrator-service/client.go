@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpClient is shared by every call to a downstream service so connections are pooled.
+// It has no overall timeout: each call is bounded by the deadline of the saga step that makes it.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// StatusError is a downstream response with an unexpected status code
+type StatusError struct {
+	Service    string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s service returned status %d", e.Service, e.StatusCode)
+}
+
+type idempotencyKeyContext struct{}
+
+// withIdempotencyKey makes every request sent with ctx carry key as its Idempotency-Key header
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+// sendJSON sends body as JSON to url through breaker and returns the response, which the caller must close.
+// It fails with a *CircuitOpenError without calling the service while the breaker is open.
+func sendJSON(ctx context.Context, breaker *CircuitBreaker, method, url string, body interface{}) (*http.Response, error) {
+	req, err := newJSONRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if err := breaker.Allow(); err != nil {
+		return nil, err
+	}
+	return doRequest(req, breaker)
+}
+
+// deliverJSON is sendJSON without the open check. Compensations use it: undoing a step must still be
+// attempted while the circuit is open, and its outcome still counts towards the breaker.
+func deliverJSON(ctx context.Context, breaker *CircuitBreaker, method, url string, body interface{}) (*http.Response, error) {
+	req, err := newJSONRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return doRequest(req, breaker)
+}
+
+// newJSONRequest builds a request with body encoded as JSON; a nil body sends none
+func newJSONRequest(ctx context.Context, method, url string, body interface{}) (*http.Request, error) {
+	var payload io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key, ok := ctx.Value(idempotencyKeyContext{}).(string); ok {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return req, nil
+}
+
+// doRequest sends req and records on breaker whether the service failed it
+func doRequest(req *http.Request, breaker *CircuitBreaker) (*http.Response, error) {
+	resp, err := httpClient.Do(req)
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		// The orchestrator gave up on the call, which says nothing about the service
+		breaker.Abandon()
+	case err != nil:
+		breaker.Record(true)
+	default:
+		breaker.Record(resp.StatusCode >= 500)
+	}
+	return resp, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyRecord is the stored outcome of a request sent with an Idempotency-Key header
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+}
+
+// replayIdempotentResponse writes the stored response for key and reports whether the request was handled
+func replayIdempotentResponse(c *gin.Context, key, requestHash string) bool {
+	record, err := store.GetIdempotencyRecord(key)
+	if err == ErrIdempotencyKeyNotFound {
+		return false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return true
+	}
+
+	if record.RequestHash != requestHash {
+		c.JSON(422, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		return true
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(record.StatusCode, "application/json; charset=utf-8", record.Response)
+	return true
+}
+
+func hashRequest(request interface{}) string {
+	body, _ := json.Marshal(request)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
 )
 
 type OrchestrationRequest struct {
@@ -28,39 +34,99 @@ type OrchestrationResponse struct {
 	ID          string  `json:"id"`
 	Status      string  `json:"status"`
 	OrderID     int     `json:"order_id,omitempty"`
+	TotalAmount float64 `json:"total_amount,omitempty"`
 	SalesID     int     `json:"sales_id,omitempty"`
 	FinalAmount float64 `json:"final_amount,omitempty"`
 	Error       string  `json:"error,omitempty"`
 }
 
 type WorkflowStep struct {
-	Name     string      `json:"name"`
-	Status   string      `json:"status"`
-	Response interface{} `json:"response,omitempty"`
-	Error    string      `json:"error,omitempty"`
+	Name                 string        `json:"name"`
+	Status               string        `json:"status"`
+	Response             interface{}   `json:"response,omitempty"`
+	Error                string        `json:"error,omitempty"`
+	Compensation         interface{}   `json:"compensation,omitempty"`
+	IdempotencyKey       string        `json:"idempotency_key,omitempty"`
+	Attempts             []StepAttempt `json:"attempts,omitempty"`
+	CompensationAttempts []StepAttempt `json:"compensation_attempts,omitempty"`
+}
+
+// StepAttempt is one call of a step's action or compensation
+type StepAttempt struct {
+	Number     int       `json:"number"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+	Retryable  bool      `json:"retryable,omitempty"`
 }
 
 type Workflow struct {
 	ID       string                `json:"id"`
+	Saga     string                `json:"saga"`
 	Status   string                `json:"status"`
 	Steps    []WorkflowStep        `json:"steps"`
 	Request  OrchestrationRequest  `json:"request"`
 	Response OrchestrationResponse `json:"response"`
+	Recovery *WorkflowRecovery     `json:"recovery,omitempty"`
 }
 
-var workflows = make(map[string]*Workflow)
+var store WorkflowStore
 
 func main() {
 	godotenv.Load()
 	
+	initStore()
+	initBreakers()
+	
+	go recoverWorkflows()
+	
 	r := gin.Default()
 	
 	r.POST("/orchestrate/order", orchestrateOrder)
 	r.GET("/orchestrate/:id", getOrchestrationStatus)
 	r.POST("/orchestrate/:id/compensate", compensateWorkflow)
+	r.GET("/circuit-breakers", getCircuitBreakers)
 	
+	// Operator queue of workflows whose compensation ran out of attempts
+	admin := r.Group("/admin")
+	admin.GET("/compensations/failed", listFailedCompensations)
+	admin.POST("/compensations/failed/:id/redrive", redriveCompensation)
+	
+	server := &http.Server{Addr: ":8081", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 	log.Println("Orchestrator service running on port 8081")
-	r.Run(":8081")
+	
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	
+	log.Println("Shutting down orchestrator service")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	workflows.Shutdown()
+}
+
+func initStore() {
+	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "5432"), getEnv("DB_USER", "postgres"),
+		getEnv("DB_PASSWORD", "postgres"), getEnv("DB_NAME", "orchestrator"))
+
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = db.Ping(); err != nil {
+		log.Fatal(err)
+	}
+
+	store = NewPostgresWorkflowStore(db)
+	workflows = NewWorkflowManager(store)
 }
 
 func orchestrateOrder(c *gin.Context) {
@@ -70,90 +136,85 @@ func orchestrateOrder(c *gin.Context) {
 		return
 	}
 	
+	key := c.GetHeader("Idempotency-Key")
+	requestHash := hashRequest(req)
+	if key != "" && replayIdempotentResponse(c, key, requestHash) {
+		return
+	}
+	
+	// Starting a workflow that cannot finish would only create an order to cancel again
+	admission, err := Admit(downstreamBreakers()...)
+	if rejectOpenCircuit(c, err) {
+		return
+	}
+	
 	workflowID := fmt.Sprintf("wf_%d", time.Now().UnixNano())
 	workflow := &Workflow{
 		ID:      workflowID,
+		Saga:    orderSaga.Name,
 		Status:  "running",
 		Request: req,
 		Steps:   []WorkflowStep{},
 	}
 	
-	workflows[workflowID] = workflow
-	
-	go executeWorkflow(workflow)
-	
-	c.JSON(202, gin.H{
+	response := gin.H{
 		"workflow_id": workflowID,
 		"status":      "accepted",
-	})
-}
-
-func executeWorkflow(workflow *Workflow) {
-	defer func() {
-		if r := recover(); r != nil {
-			workflow.Status = "failed"
-			workflow.Response.Error = fmt.Sprintf("Workflow panic: %v", r)
-		}
-	}()
+	}
 	
-	// Step 1: Create Order
-	orderStep := WorkflowStep{Name: "create_order", Status: "running"}
-	workflow.Steps = append(workflow.Steps, orderStep)
+	var idempotency *IdempotencyRecord
+	if key != "" {
+		body, _ := json.Marshal(response)
+		idempotency = &IdempotencyRecord{Key: key, RequestHash: requestHash, StatusCode: 202, Response: body}
+	}
 	
-	orderResp, err := createOrder(workflow.Request)
+	err = workflows.Start(workflow, idempotency)
 	if err != nil {
-		workflow.Steps[len(workflow.Steps)-1].Status = "failed"
-		workflow.Steps[len(workflow.Steps)-1].Error = err.Error()
-		workflow.Status = "failed"
-		workflow.Response.Error = err.Error()
+		// The workflow will never make the trial call it was admitted for
+		admission.Release()
+	}
+	if err == ErrDuplicateIdempotencyKey {
+		// A concurrent request with the same key created its workflow first
+		replayIdempotentResponse(c, key, requestHash)
 		return
 	}
-	
-	workflow.Steps[len(workflow.Steps)-1].Status = "completed"
-	workflow.Steps[len(workflow.Steps)-1].Response = orderResp
-	workflow.Response.OrderID = orderResp.ID
-	
-	// Step 2: Process Sales Transaction
-	salesStep := WorkflowStep{Name: "process_sales", Status: "running"}
-	workflow.Steps = append(workflow.Steps, salesStep)
-	
-	salesResp, err := processSales(workflow.Request, orderResp.ID, orderResp.TotalAmount)
 	if err != nil {
-		workflow.Steps[len(workflow.Steps)-1].Status = "failed"
-		workflow.Steps[len(workflow.Steps)-1].Error = err.Error()
-		
-		compensateOrder(orderResp.ID)
-		
-		workflow.Status = "compensated"
-		workflow.Response.Error = err.Error()
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 	
-	workflow.Steps[len(workflow.Steps)-1].Status = "completed"
-	workflow.Steps[len(workflow.Steps)-1].Response = salesResp
-	workflow.Response.SalesID = salesResp.ID
-	workflow.Response.FinalAmount = salesResp.FinalAmount
-	
-	// Step 3: Confirm Order
-	confirmStep := WorkflowStep{Name: "confirm_order", Status: "running"}
-	workflow.Steps = append(workflow.Steps, confirmStep)
-	
-	err = confirmOrder(orderResp.ID)
+	c.JSON(202, response)
+}
+
+// rejectOpenCircuit answers 503 with Retry-After when err is a *CircuitOpenError and reports whether it did
+func rejectOpenCircuit(c *gin.Context, err error) bool {
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) {
+		return false
+	}
+	c.Header("Retry-After", openErr.RetryAfterSeconds())
+	c.JSON(503, gin.H{"error": err.Error(), "service": openErr.Service})
+	return true
+}
+
+func executeWorkflow(ctx context.Context, workflow *Workflow) {
+	saga, err := getSaga(workflow.Saga)
 	if err != nil {
-		workflow.Steps[len(workflow.Steps)-1].Status = "failed"
-		workflow.Steps[len(workflow.Steps)-1].Error = err.Error()
-		
-		compensateSales(salesResp.ID)
-		compensateOrder(orderResp.ID)
-		
-		workflow.Status = "compensated"
+		workflow.Status = "failed"
 		workflow.Response.Error = err.Error()
+		saveWorkflow(workflow)
 		return
 	}
 	
-	workflow.Steps[len(workflow.Steps)-1].Status = "completed"
-	workflow.Status = "completed"
-	workflow.Response.Status = "success"
+	saga.Run(ctx, workflow)
+}
+
+// saveWorkflow publishes and persists the workflow after every state change so status reads see it
+// and a restart does not lose it. Only the workflow's owner may call it.
+func saveWorkflow(workflow *Workflow) {
+	if err := workflows.Save(workflow); err != nil {
+		log.Printf("Failed to save workflow %s: %v", workflow.ID, err)
+	}
 }
 
 type OrderResponse struct {
@@ -168,7 +229,7 @@ type SalesResponse struct {
 	Status      string  `json:"status"`
 }
 
-func createOrder(req OrchestrationRequest) (*OrderResponse, error) {
+func createOrder(ctx context.Context, req OrchestrationRequest) (*OrderResponse, error) {
 	orderServiceURL := getEnv("ORDER_SERVICE_URL", "http://localhost:8080")
 	
 	orderReq := map[string]interface{}{
@@ -176,15 +237,14 @@ func createOrder(req OrchestrationRequest) (*OrderResponse, error) {
 		"items":       req.Items,
 	}
 	
-	jsonData, _ := json.Marshal(orderReq)
-	resp, err := http.Post(orderServiceURL+"/orders", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := sendJSON(ctx, orderServiceBreaker, "POST", orderServiceURL+"/orders", orderReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create order: %v", err)
+		return nil, fmt.Errorf("failed to create order: %w", err)
 	}
 	defer resp.Body.Close()
 	
 	if resp.StatusCode != 201 {
-		return nil, fmt.Errorf("order service returned status %d", resp.StatusCode)
+		return nil, &StatusError{Service: "order", StatusCode: resp.StatusCode}
 	}
 	
 	var orderResp OrderResponse
@@ -195,7 +255,7 @@ func createOrder(req OrchestrationRequest) (*OrderResponse, error) {
 	return &orderResp, nil
 }
 
-func processSales(req OrchestrationRequest, orderID int, totalAmount float64) (*SalesResponse, error) {
+func processSales(ctx context.Context, req OrchestrationRequest, orderID int, totalAmount float64) (*SalesResponse, error) {
 	salesServiceURL := getEnv("SALES_SERVICE_URL", "http://localhost:3000")
 	
 	salesReq := map[string]interface{}{
@@ -205,15 +265,14 @@ func processSales(req OrchestrationRequest, orderID int, totalAmount float64) (*
 		"voucher_code":    req.VoucherCode,
 	}
 	
-	jsonData, _ := json.Marshal(salesReq)
-	resp, err := http.Post(salesServiceURL+"/sales/process", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := sendJSON(ctx, salesServiceBreaker, "POST", salesServiceURL+"/sales/process", salesReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to process sales: %v", err)
+		return nil, fmt.Errorf("failed to process sales: %w", err)
 	}
 	defer resp.Body.Close()
 	
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("sales service returned status %d", resp.StatusCode)
+		return nil, &StatusError{Service: "sales", StatusCode: resp.StatusCode}
 	}
 	
 	var salesResp SalesResponse
@@ -224,62 +283,124 @@ func processSales(req OrchestrationRequest, orderID int, totalAmount float64) (*
 	return &salesResp, nil
 }
 
-func confirmOrder(orderID int) error {
+func confirmOrder(ctx context.Context, orderID int, reason string) error {
 	orderServiceURL := getEnv("ORDER_SERVICE_URL", "http://localhost:8080")
 	
-	statusReq := map[string]string{"status": "completed"}
-	jsonData, _ := json.Marshal(statusReq)
-	
-	client := &http.Client{}
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/orders/%d/status", orderServiceURL, orderID), bytes.NewBuffer(jsonData))
-	req.Header.Set("Content-Type", "application/json")
+	statusReq := map[string]string{"status": "completed", "changed_by": "orchestrator", "reason": reason}
 	
-	resp, err := client.Do(req)
+	resp, err := sendJSON(ctx, orderServiceBreaker, "PUT", fmt.Sprintf("%s/orders/%d/status", orderServiceURL, orderID), statusReq)
 	if err != nil {
-		return fmt.Errorf("failed to confirm order: %v", err)
+		return fmt.Errorf("failed to confirm order: %w", err)
 	}
 	defer resp.Body.Close()
 	
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("order service returned status %d", resp.StatusCode)
+		return &StatusError{Service: "order", StatusCode: resp.StatusCode}
 	}
 	
 	return nil
 }
 
-func compensateOrder(orderID int) error {
+func compensateOrder(ctx context.Context, orderID int, reason string) error {
 	orderServiceURL := getEnv("ORDER_SERVICE_URL", "http://localhost:8080")
 	
-	statusReq := map[string]string{"status": "cancelled"}
-	jsonData, _ := json.Marshal(statusReq)
+	statusReq := map[string]string{"status": "cancelled", "changed_by": "orchestrator", "reason": reason}
 	
-	client := &http.Client{}
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/orders/%d/status", orderServiceURL, orderID), bytes.NewBuffer(jsonData))
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := client.Do(req)
+	resp, err := deliverJSON(ctx, orderServiceBreaker, "PUT", fmt.Sprintf("%s/orders/%d/status", orderServiceURL, orderID), statusReq)
 	if err != nil {
-		log.Printf("Failed to compensate order %d: %v", orderID, err)
-		return err
+		return fmt.Errorf("failed to cancel order %d: %w", orderID, err)
 	}
 	defer resp.Body.Close()
 	
+	if resp.StatusCode != 200 {
+		return &StatusError{Service: "order", StatusCode: resp.StatusCode}
+	}
+	
 	return nil
 }
 
-func compensateSales(salesID int) error {
-	log.Printf("Compensating sales transaction %d", salesID)
-	return nil
+func compensateSales(ctx context.Context, salesID int, reason string) (*SalesResponse, error) {
+	salesServiceURL := getEnv("SALES_SERVICE_URL", "http://localhost:3000")
+	
+	voidReq := map[string]string{"reason": reason}
+	
+	resp, err := deliverJSON(ctx, salesServiceBreaker, "POST", fmt.Sprintf("%s/sales/%d/void", salesServiceURL, salesID), voidReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to void sales transaction %d: %w", salesID, err)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{Service: "sales", StatusCode: resp.StatusCode}
+	}
+	
+	var salesResp SalesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&salesResp); err != nil {
+		return nil, fmt.Errorf("failed to decode void response: %v", err)
+	}
+	
+	return &salesResp, nil
+}
+
+// findSale returns the transaction sales-service created for orderID under idempotencyKey, or nil if there is none
+func findSale(ctx context.Context, orderID int, idempotencyKey string) (*SalesResponse, error) {
+	salesServiceURL := getEnv("SALES_SERVICE_URL", "http://localhost:3000")
+	
+	lookupURL := fmt.Sprintf("%s/sales/%d?idempotency_key=%s", salesServiceURL, orderID, url.QueryEscape(idempotencyKey))
+	resp, err := deliverJSON(ctx, salesServiceBreaker, "GET", lookupURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up sales transaction of order %d: %w", orderID, err)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{Service: "sales", StatusCode: resp.StatusCode}
+	}
+	
+	var salesResp SalesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&salesResp); err != nil {
+		return nil, fmt.Errorf("failed to decode sales transaction: %v", err)
+	}
+	
+	return &salesResp, nil
+}
+
+func getOrderStatus(ctx context.Context, orderID int) (string, error) {
+	orderServiceURL := getEnv("ORDER_SERVICE_URL", "http://localhost:8080")
+	
+	resp, err := deliverJSON(ctx, orderServiceBreaker, "GET", fmt.Sprintf("%s/orders/%d", orderServiceURL, orderID), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to load order %d: %w", orderID, err)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != 200 {
+		return "", &StatusError{Service: "order", StatusCode: resp.StatusCode}
+	}
+	
+	var orderResp OrderResponse
+	if err := json.NewDecoder(resp.Body).Decode(&orderResp); err != nil {
+		return "", fmt.Errorf("failed to decode order response: %v", err)
+	}
+	
+	return orderResp.Status, nil
 }
 
 func getOrchestrationStatus(c *gin.Context) {
 	workflowID := c.Param("id")
 	
-	workflow, exists := workflows[workflowID]
-	if !exists {
+	workflow, err := workflows.Snapshot(workflowID)
+	if err == ErrWorkflowNotFound {
 		c.JSON(404, gin.H{"error": "Workflow not found"})
 		return
 	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
 	
 	c.JSON(200, workflow)
 }
@@ -287,39 +408,68 @@ func getOrchestrationStatus(c *gin.Context) {
 func compensateWorkflow(c *gin.Context) {
 	workflowID := c.Param("id")
 	
-	workflow, exists := workflows[workflowID]
-	if !exists {
+	err := workflows.Compensate(workflowID)
+	switch err {
+	case nil:
+	case ErrWorkflowNotFound:
 		c.JSON(404, gin.H{"error": "Workflow not found"})
 		return
+	case ErrWorkflowNotFailed:
+		c.JSON(400, gin.H{"error": "Can only compensate failed workflows"})
+		return
+	case ErrWorkflowBusy:
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
 	
-	if workflow.Status != "failed" {
-		c.JSON(400, gin.H{"error": "Can only compensate failed workflows"})
+	c.JSON(202, gin.H{"message": "Workflow compensation started", "workflow_id": workflowID})
+}
+
+func listFailedCompensations(c *gin.Context) {
+	failed, err := store.ListByStatus("compensation_failed")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	if failed == nil {
+		failed = []*Workflow{}
+	}
 	
-	for i := len(workflow.Steps) - 1; i >= 0; i-- {
-		step := workflow.Steps[i]
-		if step.Status == "completed" {
-			switch step.Name {
-			case "confirm_order":
-				if workflow.Response.OrderID > 0 {
-					compensateOrder(workflow.Response.OrderID)
-				}
-			case "process_sales":
-				if workflow.Response.SalesID > 0 {
-					compensateSales(workflow.Response.SalesID)
-				}
-			case "create_order":
-				if workflow.Response.OrderID > 0 {
-					compensateOrder(workflow.Response.OrderID)
-				}
-			}
-		}
+	c.JSON(200, failed)
+}
+
+func redriveCompensation(c *gin.Context) {
+	workflowID := c.Param("id")
+	
+	err := workflows.RedriveCompensation(workflowID)
+	switch err {
+	case nil:
+	case ErrWorkflowNotFound:
+		c.JSON(404, gin.H{"error": "Workflow not found"})
+		return
+	case ErrCompensationNotFailed:
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	case ErrWorkflowBusy:
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
 	
-	workflow.Status = "compensated"
-	c.JSON(200, gin.H{"message": "Workflow compensated"})
+	c.JSON(202, gin.H{"message": "Workflow compensation re-driven", "workflow_id": workflowID})
+}
+
+func getCircuitBreakers(c *gin.Context) {
+	statuses := []BreakerStatus{}
+	for _, breaker := range downstreamBreakers() {
+		statuses = append(statuses, breaker.Status())
+	}
+	c.JSON(200, statuses)
 }
 
 func getEnv(key, defaultValue string) string {
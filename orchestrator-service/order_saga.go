@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// orderSaga creates the order, charges it through sales-service and then confirms it.
+// Every step sends an idempotency key, so all of them can be retried and resumed after a restart.
+var orderSaga = &SagaDefinition{
+	Name: "order",
+	Steps: []SagaStep{
+		{Name: "create_order", Action: createOrderStep, Compensate: cancelOrderStep, Idempotent: true, Timeout: 10 * time.Second,
+			Retry: transientRetryPolicy, CompensationRetry: compensationRetryPolicy},
+		{Name: "process_sales", Action: processSalesStep, Compensate: compensateSalesStep, Verify: verifySalesStep, Idempotent: true,
+			Timeout: 15 * time.Second, Retry: transientRetryPolicy, CompensationRetry: compensationRetryPolicy},
+		{Name: "confirm_order", Action: confirmOrderStep, Verify: verifyConfirmOrderStep, Idempotent: true, Timeout: 5 * time.Second,
+			Retry: transientRetryPolicy},
+	},
+}
+
+func init() {
+	registerSaga(orderSaga)
+}
+
+func createOrderStep(ctx context.Context, workflow *Workflow) (interface{}, error) {
+	orderResp, err := createOrder(ctx, workflow.Request)
+	if err != nil {
+		return nil, err
+	}
+	workflow.Response.OrderID = orderResp.ID
+	workflow.Response.TotalAmount = orderResp.TotalAmount
+	return orderResp, nil
+}
+
+// cancelOrderStep cancels the order unless it already is. An order whose create_order timed out before
+// its ID was known is not cancelled here; its stock hold expires and the reservation sweeper cancels it.
+func cancelOrderStep(ctx context.Context, workflow *Workflow) (interface{}, error) {
+	if workflow.Response.OrderID == 0 {
+		return nil, nil
+	}
+
+	status, err := getOrderStatus(ctx, workflow.Response.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case "cancelled":
+		return nil, nil
+	case "completed":
+		return nil, fmt.Errorf("order %d is already completed and cannot be cancelled", workflow.Response.OrderID)
+	}
+	return nil, compensateOrder(ctx, workflow.Response.OrderID, "workflow "+workflow.ID+" compensated")
+}
+
+func processSalesStep(ctx context.Context, workflow *Workflow) (interface{}, error) {
+	salesResp, err := processSales(ctx, workflow.Request, workflow.Response.OrderID, workflow.Response.TotalAmount)
+	if err != nil {
+		return nil, err
+	}
+	workflow.Response.SalesID = salesResp.ID
+	workflow.Response.FinalAmount = salesResp.FinalAmount
+	return salesResp, nil
+}
+
+// verifySalesStep looks for the transaction a timed out process_sales may have committed
+func verifySalesStep(ctx context.Context, workflow *Workflow) (interface{}, bool, error) {
+	salesResp, err := findSale(ctx, workflow.Response.OrderID, stepIdempotencyKey(workflow, "process_sales"))
+	if err != nil || salesResp == nil {
+		return nil, false, err
+	}
+	workflow.Response.SalesID = salesResp.ID
+	workflow.Response.FinalAmount = salesResp.FinalAmount
+	return salesResp, true, nil
+}
+
+// compensateSalesStep voids the charge. When process_sales timed out its transaction ID was never
+// recorded, so the transaction is looked up by the step's idempotency key first.
+func compensateSalesStep(ctx context.Context, workflow *Workflow) (interface{}, error) {
+	salesID := workflow.Response.SalesID
+	if salesID == 0 {
+		salesResp, err := findSale(ctx, workflow.Response.OrderID, stepIdempotencyKey(workflow, "process_sales"))
+		if err != nil || salesResp == nil {
+			return nil, err
+		}
+		salesID = salesResp.ID
+	}
+	return compensateSales(ctx, salesID, "workflow "+workflow.ID+" compensated")
+}
+
+func confirmOrderStep(ctx context.Context, workflow *Workflow) (interface{}, error) {
+	return nil, confirmOrder(ctx, workflow.Response.OrderID, "workflow "+workflow.ID+" completed")
+}
+
+// verifyConfirmOrderStep reports whether a timed out confirm_order completed the order anyway
+func verifyConfirmOrderStep(ctx context.Context, workflow *Workflow) (interface{}, bool, error) {
+	status, err := getOrderStatus(ctx, workflow.Response.OrderID)
+	return nil, status == "completed", err
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stubDownstream stands in for order-service and sales-service. Customers listed in rejectOrder get their
+// order refused and those in failConfirm get it refused at confirmation, after the sale went through.
+type stubDownstream struct {
+	server *httptest.Server
+
+	rejectOrder func(customerID int) bool
+	failConfirm func(customerID int) bool
+
+	mu       sync.Mutex
+	nextID   int
+	orders   map[int]*stubOrder
+	sales    map[int]string
+	requests []string
+}
+
+type stubOrder struct {
+	CustomerID int
+	Status     string
+}
+
+func newStubDownstream(t *testing.T) *stubDownstream {
+	gin.SetMode(gin.TestMode)
+	d := &stubDownstream{
+		rejectOrder: func(int) bool { return false },
+		failConfirm: func(int) bool { return false },
+		orders:      make(map[int]*stubOrder),
+		sales:       make(map[int]string),
+	}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		d.mu.Lock()
+		d.requests = append(d.requests, c.Request.Method+" "+c.Request.URL.Path)
+		d.mu.Unlock()
+	})
+	r.POST("/orders", d.createOrder)
+	r.GET("/orders/:id", d.getOrder)
+	r.PUT("/orders/:id/status", d.updateOrderStatus)
+	r.POST("/sales/process", d.processSales)
+	r.POST("/sales/:id/void", d.voidSale)
+	r.GET("/sales/:id", func(c *gin.Context) { c.JSON(404, gin.H{"error": "Sales transaction not found"}) })
+
+	d.server = httptest.NewServer(r)
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+func (d *stubDownstream) createOrder(c *gin.Context) {
+	var req struct {
+		CustomerID int `json:"customer_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if d.rejectOrder(req.CustomerID) {
+		c.JSON(409, gin.H{"error": "insufficient stock"})
+		return
+	}
+
+	d.mu.Lock()
+	d.nextID++
+	id := d.nextID
+	d.orders[id] = &stubOrder{CustomerID: req.CustomerID, Status: "pending"}
+	d.mu.Unlock()
+
+	c.JSON(201, OrderResponse{ID: id, TotalAmount: 10, Status: "pending"})
+}
+
+func (d *stubDownstream) getOrder(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	order, exists := d.orders[id]
+	if !exists {
+		c.JSON(404, gin.H{"error": "Order not found"})
+		return
+	}
+	c.JSON(200, OrderResponse{ID: id, TotalAmount: 10, Status: order.Status})
+}
+
+func (d *stubDownstream) updateOrderStatus(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	order, exists := d.orders[id]
+	if !exists {
+		c.JSON(404, gin.H{"error": "Order not found"})
+		return
+	}
+	if req.Status == "completed" && d.failConfirm(order.CustomerID) {
+		c.JSON(409, gin.H{"error": "stock reservation expired"})
+		return
+	}
+	order.Status = req.Status
+	c.JSON(200, gin.H{"message": "Order status updated"})
+}
+
+func (d *stubDownstream) processSales(c *gin.Context) {
+	var req struct {
+		OrderID int `json:"order_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	d.mu.Lock()
+	d.nextID++
+	id := d.nextID
+	d.sales[id] = "completed"
+	d.mu.Unlock()
+
+	c.JSON(200, SalesResponse{ID: id, FinalAmount: 9, Status: "completed"})
+}
+
+func (d *stubDownstream) voidSale(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.sales[id]; !exists {
+		c.JSON(404, gin.H{"error": "Sales transaction not found"})
+		return
+	}
+	d.sales[id] = "voided"
+	c.JSON(200, SalesResponse{ID: id, FinalAmount: 9, Status: "voided"})
+}
+
+func (d *stubDownstream) orderStatus(id int) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if order, exists := d.orders[id]; exists {
+		return order.Status
+	}
+	return ""
+}
+
+func (d *stubDownstream) called(request string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, r := range d.requests {
+		if r == request {
+			return true
+		}
+	}
+	return false
+}
+
+// setupOrchestrator points the orchestrator at downstream with an in-memory store and returns its router
+func setupOrchestrator(t *testing.T, downstream *stubDownstream) *gin.Engine {
+	t.Setenv("ORDER_SERVICE_URL", downstream.server.URL)
+	t.Setenv("SALES_SERVICE_URL", downstream.server.URL)
+
+	store = NewMemoryWorkflowStore()
+	workflows = NewWorkflowManager(store)
+	initBreakers()
+	t.Cleanup(workflows.Shutdown)
+
+	r := gin.New()
+	r.POST("/orchestrate/order", orchestrateOrder)
+	r.GET("/orchestrate/:id", getOrchestrationStatus)
+	r.POST("/orchestrate/:id/compensate", compensateWorkflow)
+	return r
+}
+
+// waitForStatus polls the workflow until it has one of statuses
+func waitForStatus(t *testing.T, id string, statuses ...string) *Workflow {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		workflow, err := workflows.Snapshot(id)
+		if err != nil {
+			t.Fatalf("Snapshot(%s): %v", id, err)
+		}
+		for _, status := range statuses {
+			if workflow.Status == status {
+				return workflow
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workflow %s is still %s, want one of %v", id, workflow.Status, statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newRequest(method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+}
+
+func postOrder(r http.Handler, customerID int) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	body := `{"customer_id":` + strconv.Itoa(customerID) + `,"items":[{"product_id":1,"quantity":1}]}`
+	r.ServeHTTP(w, newRequest("POST", "/orchestrate/order", body))
+	return w
+}
+
+func startOrder(t *testing.T, r http.Handler, customerID int) string {
+	w := postOrder(r, customerID)
+	if w.Code != 202 {
+		t.Fatalf("POST /orchestrate/order answered %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		WorkflowID string `json:"workflow_id"`
+	}
+	decodeBody(t, w, &resp)
+	return resp.WorkflowID
+}
+
+func TestOrderSagaVoidsSaleWhenConfirmFails(t *testing.T) {
+	downstream := newStubDownstream(t)
+	downstream.failConfirm = func(int) bool { return true }
+	r := setupOrchestrator(t, downstream)
+
+	workflow := waitForStatus(t, startOrder(t, r, 7), "compensated", "compensation_failed", "completed", "failed")
+	if workflow.Status != "compensated" {
+		t.Fatalf("workflow ended %s, want compensated: %+v", workflow.Status, workflow.Steps)
+	}
+
+	salesID := workflow.Response.SalesID
+	if !downstream.called("POST /sales/" + strconv.Itoa(salesID) + "/void") {
+		t.Fatalf("sale %d was not voided", salesID)
+	}
+
+	var sales *WorkflowStep
+	for i := range workflow.Steps {
+		if workflow.Steps[i].Name == "process_sales" {
+			sales = &workflow.Steps[i]
+		}
+	}
+	if sales == nil || sales.Status != "compensated" {
+		t.Fatalf("process_sales step is %+v, want compensated", sales)
+	}
+	voided, ok := sales.Compensation.(*SalesResponse)
+	if !ok || voided.ID != salesID || voided.Status != "voided" {
+		t.Fatalf("process_sales compensation is %#v, want the voided sale %d", sales.Compensation, salesID)
+	}
+
+	// The order is cancelled as well, and the stored copy agrees with the live one
+	if status := downstream.orderStatus(workflow.Response.OrderID); status != "cancelled" {
+		t.Fatalf("order %d is %s, want cancelled", workflow.Response.OrderID, status)
+	}
+	stored, err := store.Get(workflow.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if stored.Status != "compensated" {
+		t.Fatalf("stored workflow is %s, want compensated", stored.Status)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// WorkflowRecovery records what the orchestrator decided for a workflow it found running at startup
+type WorkflowRecovery struct {
+	Action      string    `json:"action"`
+	Reason      string    `json:"reason"`
+	RecoveredAt time.Time `json:"recovered_at"`
+}
+
+// recoverWorkflows picks up workflows left "running" or "compensating" by a previous process and hands
+// each to its own owner goroutine, which drives it to a final state
+func recoverWorkflows() {
+	for _, status := range []string{"running", "compensating"} {
+		interrupted, err := store.ListByStatus(status)
+		if err != nil {
+			log.Printf("Failed to load %s workflows for recovery: %v", status, err)
+			continue
+		}
+
+		for _, workflow := range interrupted {
+			if err := workflows.Recover(workflow.ID); err != nil {
+				log.Printf("Skipping recovery of workflow %s: %v", workflow.ID, err)
+			}
+		}
+	}
+}
+
+func recoverWorkflow(ctx context.Context, workflow *Workflow) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovery of workflow %s panicked: %v", workflow.ID, r)
+		}
+	}()
+
+	saga, err := getSaga(workflow.Saga)
+	if err != nil {
+		recordRecovery(workflow, "failed", err.Error())
+		workflow.Status = "failed"
+		workflow.Response.Error = err.Error()
+		saveWorkflow(workflow)
+		log.Printf("Recovered workflow %s: %s (%s)", workflow.ID, workflow.Recovery.Action, workflow.Recovery.Reason)
+		return
+	}
+
+	if workflow.Status == "compensating" {
+		recordRecovery(workflow, "compensating", "resuming compensation")
+		saveWorkflow(workflow)
+		saga.Compensate(ctx, workflow)
+		log.Printf("Recovered workflow %s: %s (%s)", workflow.ID, workflow.Recovery.Action, workflow.Recovery.Reason)
+		return
+	}
+
+	// A step still marked running was cut off mid-call; its outcome downstream is unknown
+	interrupted := ""
+	for i := range workflow.Steps {
+		if workflow.Steps[i].Status == "running" {
+			workflow.Steps[i].Status = "interrupted"
+			workflow.Steps[i].Error = "orchestrator restarted while step was running"
+			interrupted = workflow.Steps[i].Name
+		}
+	}
+
+	next := saga.nextStep(workflow)
+	switch {
+	case next == len(saga.Steps):
+		recordRecovery(workflow, "completed", "all steps completed before restart")
+		workflow.Status = "completed"
+		workflow.Response.Status = "success"
+		saveWorkflow(workflow)
+	case interrupted == saga.Steps[next].Name && !saga.Steps[next].Idempotent:
+		// Running the step again could apply it twice, so the completed steps are unwound instead
+		recordRecovery(workflow, "compensated", fmt.Sprintf("interrupted during %s; its outcome is unknown", interrupted))
+		workflow.Response.Error = "workflow interrupted by orchestrator restart"
+		saga.Compensate(ctx, workflow)
+	default:
+		recordRecovery(workflow, "resumed", fmt.Sprintf("resuming at %s", saga.Steps[next].Name))
+		saveWorkflow(workflow)
+		saga.Run(ctx, workflow)
+	}
+
+	log.Printf("Recovered workflow %s: %s (%s)", workflow.ID, workflow.Recovery.Action, workflow.Recovery.Reason)
+}
+
+func recordRecovery(workflow *Workflow, action, reason string) {
+	workflow.Recovery = &WorkflowRecovery{
+		Action:      action,
+		Reason:      reason,
+		RecoveredAt: time.Now(),
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// seedInterrupted stores an order workflow that a previous process left running during step, with every
+// earlier step completed against downstream
+func seedInterrupted(t *testing.T, downstream *stubDownstream, saga string, step int) *Workflow {
+	workflow := &Workflow{
+		ID:      "wf_interrupted_" + strconv.Itoa(step),
+		Saga:    saga,
+		Status:  "running",
+		Request: OrchestrationRequest{CustomerID: 7, Items: []OrderItem{{ProductID: 1, Quantity: 1}}},
+	}
+
+	downstream.mu.Lock()
+	if step > 0 {
+		downstream.nextID++
+		workflow.Response.OrderID = downstream.nextID
+		workflow.Response.TotalAmount = 10
+		downstream.orders[downstream.nextID] = &stubOrder{CustomerID: 7, Status: "pending"}
+		workflow.Steps = append(workflow.Steps, WorkflowStep{Name: "create_order", Status: "completed",
+			Response: &OrderResponse{ID: workflow.Response.OrderID, TotalAmount: 10, Status: "pending"}})
+	}
+	if step > 1 {
+		downstream.nextID++
+		workflow.Response.SalesID = downstream.nextID
+		workflow.Response.FinalAmount = 9
+		downstream.sales[downstream.nextID] = "completed"
+		workflow.Steps = append(workflow.Steps, WorkflowStep{Name: "process_sales", Status: "completed",
+			Response: &SalesResponse{ID: workflow.Response.SalesID, FinalAmount: 9, Status: "completed"}})
+	}
+	downstream.mu.Unlock()
+
+	workflow.Steps = append(workflow.Steps, WorkflowStep{Name: orderSaga.Steps[step].Name, Status: "running"})
+	if err := store.Create(workflow, nil); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return workflow
+}
+
+// recoverAndWait runs startup recovery and waits for the workflow to reach a final state
+func recoverAndWait(t *testing.T, id string) *Workflow {
+	recoverWorkflows()
+	return waitForStatus(t, id, "completed", "compensated", "failed", "compensation_failed")
+}
+
+func TestRecoveryResumesAtInterruptedStep(t *testing.T) {
+	for step := range orderSaga.Steps {
+		name := orderSaga.Steps[step].Name
+		t.Run(name, func(t *testing.T) {
+			downstream := newStubDownstream(t)
+			setupOrchestrator(t, downstream)
+			seeded := seedInterrupted(t, downstream, orderSaga.Name, step)
+
+			workflow := recoverAndWait(t, seeded.ID)
+			if workflow.Status != "completed" {
+				t.Fatalf("workflow ended %s, want completed: %+v", workflow.Status, workflow.Steps)
+			}
+			if workflow.Recovery == nil || workflow.Recovery.Action != "resumed" || workflow.Recovery.Reason != "resuming at "+name {
+				t.Fatalf("recovery is %+v, want resumed at %s", workflow.Recovery, name)
+			}
+
+			interrupted := workflow.Steps[step]
+			if interrupted.Name != name || interrupted.Status != "interrupted" || interrupted.Error == "" {
+				t.Fatalf("step %d is %+v, want %s interrupted", step, interrupted, name)
+			}
+			for _, later := range workflow.Steps[step+1:] {
+				if later.Status != "completed" {
+					t.Fatalf("step %s is %s after resuming, want completed", later.Name, later.Status)
+				}
+			}
+			if status := downstream.orderStatus(workflow.Response.OrderID); status != "completed" {
+				t.Fatalf("order %d is %s, want completed", workflow.Response.OrderID, status)
+			}
+		})
+	}
+}
+
+func TestRecoveryCompletesWorkflowWhoseStepsAllCompleted(t *testing.T) {
+	downstream := newStubDownstream(t)
+	setupOrchestrator(t, downstream)
+	seeded := seedInterrupted(t, downstream, orderSaga.Name, 2)
+	seeded.Steps[2].Status = "completed"
+	if err := store.Save(seeded); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	workflow := recoverAndWait(t, seeded.ID)
+	if workflow.Status != "completed" || workflow.Recovery == nil || workflow.Recovery.Action != "completed" {
+		t.Fatalf("workflow ended %s with recovery %+v, want completed", workflow.Status, workflow.Recovery)
+	}
+	if downstream.called("PUT /orders/" + strconv.Itoa(workflow.Response.OrderID) + "/status") {
+		t.Fatalf("confirm_order was run again")
+	}
+}
+
+// A step that cannot safely run twice is not resumed; the steps before it are unwound instead
+func TestRecoveryCompensatesInterruptedNonIdempotentStep(t *testing.T) {
+	saga := &SagaDefinition{Name: "order_non_idempotent_sales", Steps: append([]SagaStep(nil), orderSaga.Steps...)}
+	saga.Steps[1].Idempotent = false
+	registerSaga(saga)
+	t.Cleanup(func() { delete(sagaDefinitions, saga.Name) })
+
+	downstream := newStubDownstream(t)
+	setupOrchestrator(t, downstream)
+	seeded := seedInterrupted(t, downstream, saga.Name, 1)
+
+	workflow := recoverAndWait(t, seeded.ID)
+	if workflow.Status != "compensated" {
+		t.Fatalf("workflow ended %s, want compensated: %+v", workflow.Status, workflow.Steps)
+	}
+	want := "interrupted during process_sales; its outcome is unknown"
+	if workflow.Recovery == nil || workflow.Recovery.Action != "compensated" || workflow.Recovery.Reason != want {
+		t.Fatalf("recovery is %+v, want compensated because %q", workflow.Recovery, want)
+	}
+	if downstream.called("POST /sales/process") {
+		t.Fatalf("process_sales was run again")
+	}
+	for _, step := range workflow.Steps {
+		if step.Status != "compensated" {
+			t.Fatalf("step %s is %s, want compensated", step.Name, step.Status)
+		}
+	}
+	if status := downstream.orderStatus(workflow.Response.OrderID); status != "cancelled" {
+		t.Fatalf("order %d is %s, want cancelled", workflow.Response.OrderID, status)
+	}
+}
+
+func TestRecoveryResumesCompensation(t *testing.T) {
+	downstream := newStubDownstream(t)
+	setupOrchestrator(t, downstream)
+	seeded := seedInterrupted(t, downstream, orderSaga.Name, 2)
+	seeded.Status = "compensating"
+	seeded.Steps[2].Status = "failed"
+	if err := store.Save(seeded); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	workflow := recoverAndWait(t, seeded.ID)
+	if workflow.Status != "compensated" {
+		t.Fatalf("workflow ended %s, want compensated: %+v", workflow.Status, workflow.Steps)
+	}
+	if workflow.Recovery == nil || workflow.Recovery.Action != "compensating" {
+		t.Fatalf("recovery is %+v, want compensating", workflow.Recovery)
+	}
+	if !downstream.called("POST /sales/" + strconv.Itoa(workflow.Response.SalesID) + "/void") {
+		t.Fatalf("sale %d was not voided", workflow.Response.SalesID)
+	}
+	if status := downstream.orderStatus(workflow.Response.OrderID); status != "cancelled" {
+		t.Fatalf("order %d is %s, want cancelled", workflow.Response.OrderID, status)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides how often a failed step action or compensation is tried again
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// RetryableStatus lists the downstream status codes worth another attempt
+	RetryableStatus []int
+	// RetryUnlessRejected retries every error except a 4xx rejection that another attempt would get again,
+	// for actions that have to succeed eventually
+	RetryUnlessRejected bool
+}
+
+// transientRetryPolicy retries overload responses, timeouts and dropped connections a few times
+var transientRetryPolicy = &RetryPolicy{
+	MaxAttempts:     3,
+	BaseDelay:       200 * time.Millisecond,
+	MaxDelay:        2 * time.Second,
+	RetryableStatus: []int{429, 502, 503, 504},
+}
+
+// compensationRetryPolicy keeps trying to undo a step for around ten seconds before giving up
+var compensationRetryPolicy = &RetryPolicy{
+	MaxAttempts:         6,
+	BaseDelay:           500 * time.Millisecond,
+	MaxDelay:            10 * time.Second,
+	RetryUnlessRejected: true,
+}
+
+// Backoff returns the wait before the attempt after the given one: BaseDelay grown exponentially and capped
+// at MaxDelay, with jitter over its upper half so steps of many workflows hitting one outage spread out
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if attempt < 32 {
+		if d := p.BaseDelay << uint(attempt-1); d > 0 && d < p.MaxDelay {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Retryable reports whether err is worth another attempt: anything but a permanent rejection under
+// RetryUnlessRejected, otherwise a transient error such as a retryable status, a timed out attempt or a
+// failed connection
+func (p *RetryPolicy) Retryable(err error) bool {
+	var statusErr *StatusError
+	if p.RetryUnlessRejected {
+		return !errors.As(err, &statusErr) || !permanentStatus(statusErr.StatusCode)
+	}
+
+	if errors.As(err, &statusErr) {
+		for _, status := range p.RetryableStatus {
+			if statusErr.StatusCode == status {
+				return true
+			}
+		}
+		return false
+	}
+
+	var opErr *net.OpError
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &opErr) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// permanentStatus reports whether a status rejects the request itself, so sending it again cannot succeed
+func permanentStatus(status int) bool {
+	return status >= 400 && status < 500 && status != 408 && status != 429
+}
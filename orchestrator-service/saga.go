@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultStepTimeout bounds steps whose definition does not set a Timeout
+const defaultStepTimeout = 10 * time.Second
+
+// StepFunc is a step's action or compensation. It must give up when ctx is done.
+type StepFunc func(ctx context.Context, workflow *Workflow) (interface{}, error)
+
+// VerifyFunc looks up downstream whether an action that timed out was applied anyway, and returns the
+// action's response if it was
+type VerifyFunc func(ctx context.Context, workflow *Workflow) (response interface{}, applied bool, err error)
+
+// SagaStep is one forward action of a saga together with the action that undoes it
+type SagaStep struct {
+	Name       string
+	Action     StepFunc
+	Compensate StepFunc
+	// Verify settles the outcome of a timed out action; without it a timed out step counts as possibly
+	// applied, and Compensate must cope with a step that never took effect
+	Verify VerifyFunc
+	// Idempotent steps can be run again after an interruption without being applied twice
+	Idempotent bool
+	// Timeout bounds one call of Action or Compensate; a step that runs out of time fails
+	Timeout time.Duration
+	// Retry is how transient failures of Action are retried; nil steps are tried once
+	Retry *RetryPolicy
+	// CompensationRetry is how failures of Compensate are retried before an operator has to step in
+	CompensationRetry *RetryPolicy
+}
+
+// idempotencyKey is sent with every attempt of the step, so downstream services apply it at most once
+func (s *SagaStep) idempotencyKey(workflow *Workflow) string {
+	return stepIdempotencyKey(workflow, s.Name)
+}
+
+func stepIdempotencyKey(workflow *Workflow, name string) string {
+	return workflow.ID + ":" + name
+}
+
+// verify calls Verify with the step's deadline and reports whether the timed out action was applied.
+// An error leaves the outcome unknown.
+func (s *SagaStep) verify(ctx context.Context, workflow *Workflow) (interface{}, bool, error) {
+	var applied bool
+	response, err := s.call(ctx, func(ctx context.Context, workflow *Workflow) (interface{}, error) {
+		response, ok, err := s.Verify(ctx, workflow)
+		applied = ok
+		return response, err
+	}, workflow)
+	return response, applied, err
+}
+
+// call runs fn with the step's deadline and reports a missed deadline as a timeout of the step
+func (s *SagaStep) call(ctx context.Context, fn StepFunc, workflow *Workflow) (interface{}, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultStepTimeout
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := fn(stepCtx, workflow)
+	if err != nil && ctx.Err() == nil && stepCtx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("step %s timed out after %s: %w", s.Name, timeout, err)
+	}
+	return result, err
+}
+
+// runAction calls the action of the step recorded at workflow.Steps[index] until it succeeds, fails with
+// an error its retry policy does not retry, or runs out of attempts. Every attempt is recorded on the step.
+func (s *SagaStep) runAction(ctx context.Context, workflow *Workflow, index int) (interface{}, error) {
+	ctx = withIdempotencyKey(ctx, workflow.Steps[index].IdempotencyKey)
+	return s.retry(ctx, workflow, "Step "+s.Name, s.Action, s.Retry, &workflow.Steps[index].Attempts)
+}
+
+// runCompensation is runAction for the step's compensation, under its CompensationRetry policy
+func (s *SagaStep) runCompensation(ctx context.Context, workflow *Workflow, index int) (interface{}, error) {
+	ctx = withIdempotencyKey(ctx, s.idempotencyKey(workflow)+":compensate")
+	return s.retry(ctx, workflow, "Compensation of step "+s.Name, s.Compensate, s.CompensationRetry, &workflow.Steps[index].CompensationAttempts)
+}
+
+// retry calls fn until it succeeds, fails with an error policy does not retry, or runs out of attempts,
+// appending every attempt to attempts. A nil policy makes a single attempt.
+func (s *SagaStep) retry(ctx context.Context, workflow *Workflow, label string, fn StepFunc, policy *RetryPolicy, attempts *[]StepAttempt) (interface{}, error) {
+	maxAttempts := 1
+	if policy != nil && policy.MaxAttempts > 1 {
+		maxAttempts = policy.MaxAttempts
+	}
+
+	for number := 1; ; number++ {
+		attempt := StepAttempt{Number: len(*attempts) + 1, StartedAt: time.Now()}
+		response, err := s.call(ctx, fn, workflow)
+		attempt.FinishedAt = time.Now()
+		if err != nil {
+			attempt.Error = err.Error()
+			attempt.Retryable = policy != nil && ctx.Err() == nil && policy.Retryable(err)
+		}
+		*attempts = append(*attempts, attempt)
+
+		if !attempt.Retryable || number == maxAttempts {
+			return response, err
+		}
+		saveWorkflow(workflow)
+
+		delay := policy.Backoff(number)
+		log.Printf("%s of workflow %s failed on attempt %d, retrying in %s: %v", label, workflow.ID, attempt.Number, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// SagaDefinition is an ordered list of steps run forward and unwound in reverse on failure
+type SagaDefinition struct {
+	Name  string
+	Steps []SagaStep
+}
+
+var sagaDefinitions = make(map[string]*SagaDefinition)
+
+func registerSaga(definition *SagaDefinition) {
+	sagaDefinitions[definition.Name] = definition
+}
+
+func getSaga(name string) (*SagaDefinition, error) {
+	definition, exists := sagaDefinitions[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown saga %q", name)
+	}
+	return definition, nil
+}
+
+func (d *SagaDefinition) step(name string) *SagaStep {
+	for i := range d.Steps {
+		if d.Steps[i].Name == name {
+			return &d.Steps[i]
+		}
+	}
+	return nil
+}
+
+// nextStep returns the index of the first step without a completed record, or len(d.Steps) when all are done
+func (d *SagaDefinition) nextStep(workflow *Workflow) int {
+	for i, step := range d.Steps {
+		if !stepCompleted(workflow, step.Name) {
+			return i
+		}
+	}
+	return len(d.Steps)
+}
+
+// Run executes every step not yet completed and unwinds the completed ones if a step fails or times out.
+// When ctx is cancelled the workflow is left running so recovery picks it up after the restart.
+func (d *SagaDefinition) Run(ctx context.Context, workflow *Workflow) {
+	defer func() {
+		if r := recover(); r != nil {
+			workflow.Status = "failed"
+			workflow.Response.Error = fmt.Sprintf("Workflow panic: %v", r)
+			saveWorkflow(workflow)
+		}
+	}()
+
+	for i := d.nextStep(workflow); i < len(d.Steps); i++ {
+		step := d.Steps[i]
+
+		workflow.Steps = append(workflow.Steps, WorkflowStep{Name: step.Name, Status: "running", IdempotencyKey: step.idempotencyKey(workflow)})
+		saveWorkflow(workflow)
+
+		response, err := step.runAction(ctx, workflow, len(workflow.Steps)-1)
+		current := &workflow.Steps[len(workflow.Steps)-1]
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Workflow %s stopped during %s: %v", workflow.ID, step.Name, ctx.Err())
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			response, err = d.settleTimeout(ctx, &step, workflow, current, err)
+		}
+		if err != nil {
+			if current.Status != "timed_out" {
+				current.Status = "failed"
+			}
+			current.Error = err.Error()
+			workflow.Response.Error = err.Error()
+			d.Compensate(ctx, workflow)
+			return
+		}
+
+		current.Status = "completed"
+		current.Response = response
+		saveWorkflow(workflow)
+	}
+
+	workflow.Status = "completed"
+	workflow.Response.Status = "success"
+	saveWorkflow(workflow)
+}
+
+// settleTimeout decides what a timed out step did downstream. If Verify finds the action applied, its
+// response is returned with no error and the saga carries on. Otherwise the step is marked timed_out when
+// its outcome stays unknown, so Compensate undoes it in case it took effect.
+func (d *SagaDefinition) settleTimeout(ctx context.Context, step *SagaStep, workflow *Workflow, current *WorkflowStep, err error) (interface{}, error) {
+	if step.Verify == nil {
+		current.Status = "timed_out"
+		return nil, err
+	}
+
+	response, applied, verifyErr := step.verify(ctx, workflow)
+	switch {
+	case verifyErr != nil:
+		log.Printf("Failed to verify timed out step %s of workflow %s: %v", step.Name, workflow.ID, verifyErr)
+		current.Status = "timed_out"
+		return nil, err
+	case applied:
+		log.Printf("Timed out step %s of workflow %s was applied downstream", step.Name, workflow.ID)
+		return response, nil
+	default:
+		return nil, err
+	}
+}
+
+// Compensate undoes every completed step in reverse order, retrying each compensation under the step's
+// CompensationRetry policy. The workflow is compensating until every compensation has succeeded, and moves
+// to compensation_failed for an operator to re-drive when one runs out of attempts. It stays failed when
+// there is nothing to undo, and stays compensating when ctx is cancelled so recovery resumes it.
+func (d *SagaDefinition) Compensate(ctx context.Context, workflow *Workflow) {
+	if !needsCompensation(workflow) {
+		workflow.Status = "failed"
+		saveWorkflow(workflow)
+		return
+	}
+
+	workflow.Status = "compensating"
+	saveWorkflow(workflow)
+
+	failed := false
+	for i := len(workflow.Steps) - 1; i >= 0; i-- {
+		recorded := &workflow.Steps[i]
+		if !mayNeedCompensation(workflow, i) {
+			continue
+		}
+
+		step := d.step(recorded.Name)
+		if step != nil && step.Compensate != nil {
+			result, err := step.runCompensation(ctx, workflow, i)
+			if err != nil && ctx.Err() != nil {
+				log.Printf("Compensation of workflow %s stopped during %s: %v", workflow.ID, recorded.Name, ctx.Err())
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to compensate step %s of workflow %s: %v", recorded.Name, workflow.ID, err)
+				recorded.Status = "compensation_failed"
+				recorded.Error = fmt.Sprintf("compensation failed: %v", err)
+				failed = true
+				saveWorkflow(workflow)
+				continue
+			}
+			recorded.Compensation = result
+		}
+		recorded.Status = "compensated"
+		recorded.Error = ""
+		saveWorkflow(workflow)
+	}
+
+	if failed {
+		workflow.Status = "compensation_failed"
+	} else {
+		workflow.Status = "compensated"
+	}
+	saveWorkflow(workflow)
+}
+
+// needsCompensation reports whether any step may have been applied and is not undone yet
+func needsCompensation(workflow *Workflow) bool {
+	for i := range workflow.Steps {
+		if mayNeedCompensation(workflow, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayNeedCompensation reports whether the step recorded at index was or may have been applied and is not
+// undone yet. Timed out and interrupted steps have an unknown outcome, unless the step was run again later.
+func mayNeedCompensation(workflow *Workflow, index int) bool {
+	switch workflow.Steps[index].Status {
+	case "completed", "compensation_failed":
+		return true
+	case "timed_out", "interrupted":
+		for _, later := range workflow.Steps[index+1:] {
+			if later.Name == workflow.Steps[index].Name {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func stepCompleted(workflow *Workflow, name string) bool {
+	for _, step := range workflow.Steps {
+		if step.Name == name && step.Status == "completed" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrWorkflowNotFound        = errors.New("workflow not found")
+	ErrIdempotencyKeyNotFound  = errors.New("idempotency key not found")
+	ErrDuplicateIdempotencyKey = errors.New("idempotency key already used")
+)
+
+// WorkflowStore persists workflows together with their request, steps and response
+type WorkflowStore interface {
+	// Create stores the workflow and, when idempotency is set, its key in the same transaction
+	Create(workflow *Workflow, idempotency *IdempotencyRecord) error
+	Get(id string) (*Workflow, error)
+	Save(workflow *Workflow) error
+	ListByStatus(status string) ([]*Workflow, error)
+	GetIdempotencyRecord(key string) (*IdempotencyRecord, error)
+}
+
+// PostgresWorkflowStore implements WorkflowStore
+type PostgresWorkflowStore struct {
+	db *sql.DB
+}
+
+func NewPostgresWorkflowStore(db *sql.DB) WorkflowStore {
+	return &PostgresWorkflowStore{db: db}
+}
+
+func (s *PostgresWorkflowStore) Create(workflow *Workflow, idempotency *IdempotencyRecord) error {
+	requestJSON, err := json.Marshal(workflow.Request)
+	if err != nil {
+		return err
+	}
+	responseJSON, err := json.Marshal(workflow.Response)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO workflows (id, saga, status, request, response) VALUES ($1, $2, $3, $4, $5)",
+		workflow.ID, workflow.Saga, workflow.Status, requestJSON, responseJSON)
+	if err != nil {
+		return err
+	}
+
+	if err = s.saveSteps(tx, workflow); err != nil {
+		return err
+	}
+
+	if idempotency != nil {
+		_, err = tx.Exec("INSERT INTO idempotency_keys (key, request_hash, status_code, response, workflow_id) VALUES ($1, $2, $3, $4, $5)",
+			idempotency.Key, idempotency.RequestHash, idempotency.StatusCode, idempotency.Response, workflow.ID)
+		if isUniqueViolation(err) {
+			return ErrDuplicateIdempotencyKey
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresWorkflowStore) Get(id string) (*Workflow, error) {
+	var workflow Workflow
+	var requestJSON, responseJSON, recoveryJSON []byte
+	err := s.db.QueryRow("SELECT id, saga, status, request, response, recovery FROM workflows WHERE id = $1", id).
+		Scan(&workflow.ID, &workflow.Saga, &workflow.Status, &requestJSON, &responseJSON, &recoveryJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrWorkflowNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(requestJSON, &workflow.Request); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(responseJSON, &workflow.Response); err != nil {
+		return nil, err
+	}
+	if recoveryJSON != nil {
+		if err = json.Unmarshal(recoveryJSON, &workflow.Recovery); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := s.db.Query("SELECT name, status, response, error, compensation, idempotency_key, attempts, compensation_attempts FROM workflow_steps WHERE workflow_id = $1 ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workflow.Steps = []WorkflowStep{}
+	for rows.Next() {
+		var step WorkflowStep
+		var stepResponse, stepCompensation, attempts, compensationAttempts []byte
+		var stepError, idempotencyKey sql.NullString
+		if err := rows.Scan(&step.Name, &step.Status, &stepResponse, &stepError, &stepCompensation, &idempotencyKey, &attempts, &compensationAttempts); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(attempts, &step.Attempts); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(compensationAttempts, &step.CompensationAttempts); err != nil {
+			return nil, err
+		}
+		if stepResponse != nil {
+			if err := json.Unmarshal(stepResponse, &step.Response); err != nil {
+				return nil, err
+			}
+		}
+		if stepCompensation != nil {
+			if err := json.Unmarshal(stepCompensation, &step.Compensation); err != nil {
+				return nil, err
+			}
+		}
+		step.Error = stepError.String
+		step.IdempotencyKey = idempotencyKey.String
+		workflow.Steps = append(workflow.Steps, step)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &workflow, nil
+}
+
+func (s *PostgresWorkflowStore) Save(workflow *Workflow) error {
+	responseJSON, err := json.Marshal(workflow.Response)
+	if err != nil {
+		return err
+	}
+	var recoveryJSON []byte
+	if workflow.Recovery != nil {
+		if recoveryJSON, err = json.Marshal(workflow.Recovery); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE workflows SET status = $1, response = $2, recovery = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $4",
+		workflow.Status, responseJSON, recoveryJSON, workflow.ID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrWorkflowNotFound
+	}
+
+	if err = s.saveSteps(tx, workflow); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresWorkflowStore) ListByStatus(status string) ([]*Workflow, error) {
+	rows, err := s.db.Query("SELECT id FROM workflows WHERE status = $1 ORDER BY created_at", status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var workflows []*Workflow
+	for _, id := range ids {
+		workflow, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		workflows = append(workflows, workflow)
+	}
+	return workflows, nil
+}
+
+func (s *PostgresWorkflowStore) GetIdempotencyRecord(key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	err := s.db.QueryRow("SELECT key, request_hash, status_code, response FROM idempotency_keys WHERE key = $1", key).
+		Scan(&record.Key, &record.RequestHash, &record.StatusCode, &record.Response)
+	if err == sql.ErrNoRows {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// saveSteps upserts every step by its position; steps are append-only so none are ever deleted
+func (s *PostgresWorkflowStore) saveSteps(tx *sql.Tx, workflow *Workflow) error {
+	for i, step := range workflow.Steps {
+		stepResponse, err := marshalNullable(step.Response)
+		if err != nil {
+			return err
+		}
+		stepCompensation, err := marshalNullable(step.Compensation)
+		if err != nil {
+			return err
+		}
+		attempts, err := json.Marshal(append([]StepAttempt{}, step.Attempts...))
+		if err != nil {
+			return err
+		}
+		compensationAttempts, err := json.Marshal(append([]StepAttempt{}, step.CompensationAttempts...))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO workflow_steps (workflow_id, position, name, status, response, error, compensation, idempotency_key, attempts, compensation_attempts)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (workflow_id, position)
+			DO UPDATE SET name = EXCLUDED.name, status = EXCLUDED.status, response = EXCLUDED.response,
+				error = EXCLUDED.error, compensation = EXCLUDED.compensation, attempts = EXCLUDED.attempts,
+				compensation_attempts = EXCLUDED.compensation_attempts`,
+			workflow.ID, i, step.Name, step.Status, stepResponse, sql.NullString{String: step.Error, Valid: step.Error != ""}, stepCompensation,
+			sql.NullString{String: step.IdempotencyKey, Valid: step.IdempotencyKey != ""}, attempts, compensationAttempts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalNullable encodes value as JSON, or returns nil so the column is stored as NULL
+func marshalNullable(value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return json.Marshal(value)
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// MemoryWorkflowStore implements WorkflowStore without a database, for tests
+type MemoryWorkflowStore struct {
+	mu          sync.Mutex
+	workflows   map[string]*Workflow
+	idempotency map[string]IdempotencyRecord
+	// created lists workflow IDs in creation order, so listings are ordered like PostgresWorkflowStore's
+	created []string
+}
+
+func NewMemoryWorkflowStore() WorkflowStore {
+	return &MemoryWorkflowStore{
+		workflows:   make(map[string]*Workflow),
+		idempotency: make(map[string]IdempotencyRecord),
+	}
+}
+
+func (s *MemoryWorkflowStore) Create(workflow *Workflow, idempotency *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if idempotency != nil {
+		if _, exists := s.idempotency[idempotency.Key]; exists {
+			return ErrDuplicateIdempotencyKey
+		}
+		s.idempotency[idempotency.Key] = *idempotency
+	}
+	s.workflows[workflow.ID] = copyWorkflow(workflow)
+	s.created = append(s.created, workflow.ID)
+	return nil
+}
+
+func (s *MemoryWorkflowStore) Get(id string) (*Workflow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	workflow, exists := s.workflows[id]
+	if !exists {
+		return nil, ErrWorkflowNotFound
+	}
+	return copyWorkflow(workflow), nil
+}
+
+func (s *MemoryWorkflowStore) Save(workflow *Workflow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.workflows[workflow.ID]; !exists {
+		return ErrWorkflowNotFound
+	}
+	s.workflows[workflow.ID] = copyWorkflow(workflow)
+	return nil
+}
+
+func (s *MemoryWorkflowStore) ListByStatus(status string) ([]*Workflow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var workflows []*Workflow
+	for _, id := range s.created {
+		if workflow := s.workflows[id]; workflow.Status == status {
+			workflows = append(workflows, copyWorkflow(workflow))
+		}
+	}
+	return workflows, nil
+}
+
+func (s *MemoryWorkflowStore) GetIdempotencyRecord(key string) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, exists := s.idempotency[key]
+	if !exists {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	return &record, nil
+}
+
+// copyWorkflow detaches the stored workflow from the caller's copy so later mutations are not shared
+func copyWorkflow(workflow *Workflow) *Workflow {
+	copied := *workflow
+	copied.Request.Items = append([]OrderItem(nil), workflow.Request.Items...)
+	copied.Steps = append([]WorkflowStep{}, workflow.Steps...)
+	for i := range copied.Steps {
+		copied.Steps[i].Attempts = append([]StepAttempt(nil), workflow.Steps[i].Attempts...)
+		copied.Steps[i].CompensationAttempts = append([]StepAttempt(nil), workflow.Steps[i].CompensationAttempts...)
+	}
+	if workflow.Recovery != nil {
+		recovery := *workflow.Recovery
+		copied.Recovery = &recovery
+	}
+	return &copied
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryWorkflowStoreListByStatusInCreationOrder(t *testing.T) {
+	s := NewMemoryWorkflowStore()
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		workflow := &Workflow{ID: fmt.Sprintf("wf_%d", i), Saga: "order", Status: "running"}
+		if i%3 == 0 {
+			workflow.Status = "completed"
+		} else {
+			want = append(want, workflow.ID)
+		}
+		if err := s.Create(workflow, nil); err != nil {
+			t.Fatalf("Create(%s): %v", workflow.ID, err)
+		}
+	}
+
+	got, err := s.ListByStatus("running")
+	if err != nil {
+		t.Fatalf("ListByStatus: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ListByStatus returned %d workflows, want %d", len(got), len(want))
+	}
+	for i, workflow := range got {
+		if workflow.ID != want[i] {
+			t.Fatalf("workflow %d is %s, want %s", i, workflow.ID, want[i])
+		}
+	}
+}
+
+func TestMemoryWorkflowStoreReturnsCopies(t *testing.T) {
+	s := NewMemoryWorkflowStore()
+	workflow := &Workflow{ID: "wf_1", Saga: "order", Status: "running", Steps: []WorkflowStep{{Name: "create_order", Status: "running"}}}
+	if err := s.Create(workflow, nil); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	workflow.Steps[0].Status = "completed"
+	loaded, err := s.Get("wf_1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if loaded.Steps[0].Status != "running" {
+		t.Fatalf("stored step changed with the caller's copy: %s", loaded.Steps[0].Status)
+	}
+
+	loaded.Status = "failed"
+	if again, _ := s.Get("wf_1"); again.Status != "running" {
+		t.Fatalf("stored workflow changed with a loaded copy: %s", again.Status)
+	}
+}
+
+func TestMemoryWorkflowStoreRejectsDuplicateIdempotencyKey(t *testing.T) {
+	s := NewMemoryWorkflowStore()
+	record := &IdempotencyRecord{Key: "key", RequestHash: "hash", StatusCode: 202}
+
+	if err := s.Create(&Workflow{ID: "wf_1", Status: "running"}, record); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Create(&Workflow{ID: "wf_2", Status: "running"}, record); err != ErrDuplicateIdempotencyKey {
+		t.Fatalf("Create with a used key returned %v, want ErrDuplicateIdempotencyKey", err)
+	}
+	if _, err := s.Get("wf_2"); err != ErrWorkflowNotFound {
+		t.Fatalf("workflow of the rejected request was stored: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrWorkflowBusy           = errors.New("workflow is being executed or compensated")
+	ErrWorkflowNotFailed      = errors.New("only failed workflows can be compensated")
+	ErrCompensationNotFailed  = errors.New("only workflows whose compensation failed can be re-driven")
+	ErrWorkflowNotInterrupted = errors.New("workflow is no longer running or compensating")
+)
+
+// WorkflowManager owns the live state of workflows. Each workflow has at most one owner goroutine
+// (the one running, recovering or compensating it), which is the only code that touches its *Workflow.
+// The owner publishes a copy after every change, and readers only ever get copies.
+// Owners run under the manager's context, so Shutdown stops every workflow at its current step.
+type WorkflowManager struct {
+	store  WorkflowStore
+	ctx    context.Context
+	cancel context.CancelFunc
+	owners sync.WaitGroup
+
+	mu sync.Mutex
+	// snapshots holds the latest published copy of every owned workflow, or nil until its owner publishes one
+	snapshots map[string]*Workflow
+}
+
+var workflows *WorkflowManager
+
+func NewWorkflowManager(store WorkflowStore) *WorkflowManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WorkflowManager{store: store, ctx: ctx, cancel: cancel, snapshots: make(map[string]*Workflow)}
+}
+
+// Shutdown cancels every owner and waits for them to return. Workflows they leave running are
+// picked up by recovery on the next start.
+func (m *WorkflowManager) Shutdown() {
+	m.cancel()
+	m.owners.Wait()
+}
+
+// acquire makes the caller the owner of the workflow, failing with ErrWorkflowBusy if it already has one
+func (m *WorkflowManager) acquire(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, owned := m.snapshots[id]; owned {
+		return ErrWorkflowBusy
+	}
+	m.snapshots[id] = nil
+	m.owners.Add(1)
+	return nil
+}
+
+func (m *WorkflowManager) publish(workflow *Workflow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, owned := m.snapshots[workflow.ID]; owned {
+		m.snapshots[workflow.ID] = copyWorkflow(workflow)
+	}
+}
+
+func (m *WorkflowManager) release(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.snapshots, id)
+	m.owners.Done()
+}
+
+// Save publishes the owner's changes to readers and persists them
+func (m *WorkflowManager) Save(workflow *Workflow) error {
+	m.publish(workflow)
+	return m.store.Save(workflow)
+}
+
+// Snapshot returns a copy of the workflow that the caller may read freely
+func (m *WorkflowManager) Snapshot(id string) (*Workflow, error) {
+	m.mu.Lock()
+	snapshot := m.snapshots[id]
+	if snapshot != nil {
+		snapshot = copyWorkflow(snapshot)
+	}
+	m.mu.Unlock()
+
+	if snapshot != nil {
+		return snapshot, nil
+	}
+	return m.store.Get(id)
+}
+
+// Start stores a new workflow, with the idempotency record of the request that created it if any, and runs
+// it in the background. Ownership is taken before the workflow is stored as running, so recovery cannot
+// pick it up in between.
+func (m *WorkflowManager) Start(workflow *Workflow, idempotency *IdempotencyRecord) error {
+	if err := m.acquire(workflow.ID); err != nil {
+		return err
+	}
+	if err := m.store.Create(workflow, idempotency); err != nil {
+		m.release(workflow.ID)
+		return err
+	}
+	m.publish(workflow)
+
+	go func() {
+		defer m.release(workflow.ID)
+		executeWorkflow(m.ctx, workflow)
+	}()
+	return nil
+}
+
+// Recover takes ownership of a workflow found running or compensating at startup and drives it to a final
+// state in the background, so one slow workflow does not hold up the recovery of the others
+func (m *WorkflowManager) Recover(id string) error {
+	if err := m.acquire(id); err != nil {
+		return err
+	}
+
+	go func() {
+		defer m.release(id)
+		if err := m.recover(id); err != nil {
+			log.Printf("Skipping recovery of workflow %s: %v", id, err)
+		}
+	}()
+	return nil
+}
+
+// recover runs on the owner goroutine. Recovery runs while the server takes traffic, so the workflow may
+// have been finished by another owner since it was listed; it is reloaded here and skipped then.
+func (m *WorkflowManager) recover(id string) error {
+	workflow, err := m.store.Get(id)
+	if err != nil {
+		return err
+	}
+	m.publish(workflow)
+	if workflow.Status != "running" && workflow.Status != "compensating" {
+		return ErrWorkflowNotInterrupted
+	}
+
+	recoverWorkflow(m.ctx, workflow)
+	return nil
+}
+
+// Compensate starts unwinding a failed workflow in the background unless another goroutine currently owns it
+func (m *WorkflowManager) Compensate(id string) error {
+	return m.unwind(id, "failed", ErrWorkflowNotFailed)
+}
+
+// RedriveCompensation starts retrying the compensations of a workflow that ran out of attempts
+func (m *WorkflowManager) RedriveCompensation(id string) error {
+	return m.unwind(id, "compensation_failed", ErrCompensationNotFailed)
+}
+
+// unwind takes ownership of the workflow and compensates it on a new owner goroutine if it has status,
+// failing with wrongStatus otherwise. Compensations are retried, so this can take a long time.
+func (m *WorkflowManager) unwind(id, status string, wrongStatus error) error {
+	if err := m.acquire(id); err != nil {
+		return err
+	}
+
+	// Loaded only after acquiring, so it includes everything the previous owner saved
+	workflow, err := m.store.Get(id)
+	if err == nil && workflow.Status != status {
+		err = wrongStatus
+	}
+	var saga *SagaDefinition
+	if err == nil {
+		saga, err = getSaga(workflow.Saga)
+	}
+	if err != nil {
+		m.release(id)
+		return err
+	}
+	m.publish(workflow)
+
+	go func() {
+		defer m.release(id)
+		saga.Compensate(m.ctx, workflow)
+	}()
+	return nil
+}
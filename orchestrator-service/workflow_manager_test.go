@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Starting, reading and compensating workflows at the same time must not share a *Workflow between
+// goroutines; run with -race.
+func TestWorkflowsStartReadAndCompensateConcurrently(t *testing.T) {
+	downstream := newStubDownstream(t)
+	downstream.rejectOrder = func(customerID int) bool { return customerID%3 == 0 }
+	downstream.failConfirm = func(customerID int) bool { return customerID%3 == 1 }
+	r := setupOrchestrator(t, downstream)
+
+	const orders = 30
+	ids := make(chan string, orders)
+	var wg sync.WaitGroup
+	for customerID := 0; customerID < orders; customerID++ {
+		wg.Add(1)
+		go func(customerID int) {
+			defer wg.Done()
+			w := postOrder(r, customerID)
+			var resp struct {
+				WorkflowID string `json:"workflow_id"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 202 || err != nil {
+				t.Errorf("POST /orchestrate/order answered %d: %s", w.Code, w.Body)
+			}
+			ids <- resp.WorkflowID
+		}(customerID)
+	}
+
+	var readers sync.WaitGroup
+	var started []string
+	for i := 0; i < orders; i++ {
+		id := <-ids
+		if id == "" {
+			continue
+		}
+		started = append(started, id)
+
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for j := 0; j < 20; j++ {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, newRequest("GET", "/orchestrate/"+id, ""))
+				if w.Code != 200 {
+					t.Errorf("GET /orchestrate/%s answered %d: %s", id, w.Code, w.Body)
+					return
+				}
+
+				w = httptest.NewRecorder()
+				r.ServeHTTP(w, newRequest("POST", "/orchestrate/"+id+"/compensate", ""))
+				switch w.Code {
+				case 202, 400, 409:
+				default:
+					t.Errorf("POST /orchestrate/%s/compensate answered %d: %s", id, w.Code, w.Body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	readers.Wait()
+
+	for _, id := range started {
+		workflow := waitForStatus(t, id, "completed", "compensated", "failed", "compensation_failed")
+		want := "completed"
+		switch workflow.Request.CustomerID % 3 {
+		case 0:
+			want = "failed"
+		case 1:
+			want = "compensated"
+		}
+		if workflow.Status != want {
+			t.Errorf("workflow %s of customer %d ended %s, want %s", id, workflow.Request.CustomerID, workflow.Status, want)
+		}
+
+		stored, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", id, err)
+		}
+		if stored.Status != workflow.Status {
+			t.Errorf("workflow %s is stored as %s but reads as %s", id, stored.Status, workflow.Status)
+		}
+	}
+}
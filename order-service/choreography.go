@@ -0,0 +1,51 @@
+package main
+
+import "order-service/events"
+
+// SagaStep is where an order is in the choreography saga
+type SagaStep string
+
+const (
+	// SagaStepAwaitingPayment orders have published ORDER_CREATED and wait for sales-service until their deadline
+	SagaStepAwaitingPayment SagaStep = "awaiting_payment"
+	SagaStepConfirmed       SagaStep = "confirmed"
+	SagaStepCancelled       SagaStep = "cancelled"
+	SagaStepTimedOut        SagaStep = "timed_out"
+)
+
+// sagaReaction is what the choreography saga does with an order awaiting payment when a sales-service
+// event arrives: the status and step it moves to, and the event it publishes afterwards
+type sagaReaction struct {
+	status   OrderStatus
+	step     SagaStep
+	followUp func(event SagaEvent) events.Payload
+}
+
+var sagaReactions = map[string]sagaReaction{
+	events.TypeSalesTransactionCompleted: {
+		status: OrderStatusConfirmed,
+		step:   SagaStepConfirmed,
+		followUp: func(event SagaEvent) events.Payload {
+			completed := event.Data.(*events.SalesTransactionCompleted)
+			return &events.OrderConfirmed{TransactionID: completed.TransactionID, FinalAmount: completed.FinalAmount}
+		},
+	},
+	events.TypeSalesTransactionFailed: {
+		status: OrderStatusCancelled,
+		step:   SagaStepCancelled,
+		followUp: func(event SagaEvent) events.Payload {
+			return &events.OrderCancelled{Reason: "payment failed: " + event.Data.(*events.SalesTransactionFailed).Error}
+		},
+	},
+}
+
+// cancelReaction cancels the order for reason, so sales-service voids whatever it charged
+func cancelReaction(reason string) sagaReaction {
+	return sagaReaction{
+		status: OrderStatusCancelled,
+		step:   SagaStepCancelled,
+		followUp: func(SagaEvent) events.Payload {
+			return &events.OrderCancelled{Reason: reason}
+		},
+	}
+}
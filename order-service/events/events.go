@@ -0,0 +1,156 @@
+// Package events defines the payload of every saga event as a versioned struct, and a registry that
+// decodes a payload from its type and schema version, upcasting older versions to the current one.
+// sales-service produces and consumes the same payloads and must be kept in step with this package.
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	TypeOrderCreated              = "ORDER_CREATED"
+	TypeOrderConfirmed            = "ORDER_CONFIRMED"
+	TypeOrderCancelled            = "ORDER_CANCELLED"
+	TypeReservationExpired        = "RESERVATION_EXPIRED"
+	TypeProductCreated            = "PRODUCT_CREATED"
+	TypeProductUpdated            = "PRODUCT_UPDATED"
+	TypeProductDeleted            = "PRODUCT_DELETED"
+	TypeSalesTransactionCompleted = "SALES_TRANSACTION_COMPLETED"
+	TypeSalesTransactionFailed    = "SALES_TRANSACTION_FAILED"
+	TypeSalesTransactionVoided    = "SALES_TRANSACTION_VOIDED"
+)
+
+var (
+	ErrUnknownType        = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported event schema version")
+	ErrInvalidPayload     = errors.New("invalid event payload")
+)
+
+// Payload is the data carried by one event type
+type Payload interface {
+	EventType() string
+}
+
+// Upcaster rewrites a payload of one schema version into the shape of the next version
+type Upcaster func(data json.RawMessage) (json.RawMessage, error)
+
+type registration struct {
+	version    int
+	newPayload func() Payload
+	// upcasters maps a version to the function that lifts it to version+1
+	upcasters map[int]Upcaster
+}
+
+// Registry maps event type strings to their current schema and the upcasters from older schemas
+type Registry struct {
+	types map[string]*registration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{types: make(map[string]*registration)}
+}
+
+// Register makes eventType decodable; version is the schema newPayload produces
+func (r *Registry) Register(eventType string, version int, newPayload func() Payload) {
+	r.types[eventType] = &registration{version: version, newPayload: newPayload, upcasters: make(map[int]Upcaster)}
+}
+
+// RegisterUpcaster adds the step from fromVersion to fromVersion+1 for an already registered type
+func (r *Registry) RegisterUpcaster(eventType string, fromVersion int, upcaster Upcaster) {
+	r.types[eventType].upcasters[fromVersion] = upcaster
+}
+
+// Version returns the schema version new events of eventType are written with
+func (r *Registry) Version(eventType string) (int, error) {
+	registered, exists := r.types[eventType]
+	if !exists {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownType, eventType)
+	}
+	return registered.version, nil
+}
+
+// Types lists every registered event type in sorted order
+func (r *Registry) Types() []string {
+	types := make([]string, 0, len(r.types))
+	for eventType := range r.types {
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New returns an empty payload of eventType at the current schema version
+func (r *Registry) New(eventType string) (Payload, error) {
+	registered, exists := r.types[eventType]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, eventType)
+	}
+	return registered.newPayload(), nil
+}
+
+// Encode returns the payload's JSON and the schema version it was written with
+func (r *Registry) Encode(payload Payload) (int, []byte, error) {
+	version, err := r.Version(payload.EventType())
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := json.Marshal(payload)
+	return version, data, err
+}
+
+// Decode upcasts data from version to the current schema and decodes it strictly into the typed payload.
+// A version of 0 means the producer did not send one and is read as version 1.
+func (r *Registry) Decode(eventType string, version int, data []byte) (Payload, error) {
+	registered, exists := r.types[eventType]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, eventType)
+	}
+	if version == 0 {
+		version = 1
+	}
+	if version > registered.version {
+		return nil, fmt.Errorf("%w: %s version %d is newer than %d", ErrUnsupportedVersion, eventType, version, registered.version)
+	}
+
+	raw := json.RawMessage(data)
+	for ; version < registered.version; version++ {
+		upcaster, exists := registered.upcasters[version]
+		if !exists {
+			return nil, fmt.Errorf("%w: no upcaster for %s version %d", ErrUnsupportedVersion, eventType, version)
+		}
+		upcast, err := upcaster(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: upcasting %s version %d: %v", ErrInvalidPayload, eventType, version, err)
+		}
+		raw = upcast
+	}
+
+	payload := registered.newPayload()
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidPayload, eventType, err)
+	}
+	return payload, nil
+}
+
+// Default holds every event type of the saga
+var Default = NewRegistry()
+
+func init() {
+	Default.Register(TypeOrderCreated, 2, func() Payload { return &OrderCreated{} })
+	Default.RegisterUpcaster(TypeOrderCreated, 1, upcastOrderCreatedV1)
+	Default.Register(TypeOrderConfirmed, 1, func() Payload { return &OrderConfirmed{} })
+	Default.Register(TypeOrderCancelled, 1, func() Payload { return &OrderCancelled{} })
+	Default.Register(TypeReservationExpired, 1, func() Payload { return &ReservationExpired{} })
+	Default.Register(TypeProductCreated, 1, func() Payload { return &ProductChanged{Type: TypeProductCreated} })
+	Default.Register(TypeProductUpdated, 1, func() Payload { return &ProductChanged{Type: TypeProductUpdated} })
+	Default.Register(TypeProductDeleted, 1, func() Payload { return &ProductChanged{Type: TypeProductDeleted} })
+	Default.Register(TypeSalesTransactionCompleted, 1, func() Payload { return &SalesTransactionCompleted{} })
+	Default.Register(TypeSalesTransactionFailed, 1, func() Payload { return &SalesTransactionFailed{} })
+	Default.Register(TypeSalesTransactionVoided, 1, func() Payload { return &SalesTransactionVoided{} })
+}
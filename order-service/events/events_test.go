@@ -0,0 +1,98 @@
+package events
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// samples holds a filled-in payload of every registered type
+func samples() map[string]Payload {
+	voucherID := 3
+	return map[string]Payload{
+		TypeOrderCreated: &OrderCreated{CustomerID: 7, TotalAmount: 30, Items: []OrderLine{
+			{ProductID: 1, Quantity: 2, Price: 10},
+			{ProductID: 2, Quantity: 1, Price: 10},
+		}},
+		TypeOrderConfirmed:            &OrderConfirmed{TransactionID: 11, FinalAmount: 27},
+		TypeOrderCancelled:            &OrderCancelled{Reason: "payment failed"},
+		TypeReservationExpired:        &ReservationExpired{Reason: "stock reservation expired"},
+		TypeProductCreated:            &ProductChanged{Type: TypeProductCreated, ID: 1, Name: "Laptop", Price: 999.5, StockQuantity: 10},
+		TypeProductUpdated:            &ProductChanged{Type: TypeProductUpdated, ID: 1, Name: "Laptop", Price: 899, StockQuantity: 8, ReservedQuantity: 2},
+		TypeProductDeleted:            &ProductChanged{Type: TypeProductDeleted, ID: 1},
+		TypeSalesTransactionCompleted: &SalesTransactionCompleted{TransactionID: 11, FinalAmount: 27, DiscountAmount: 3},
+		TypeSalesTransactionFailed:    &SalesTransactionFailed{Error: "voucher expired"},
+		TypeSalesTransactionVoided:    &SalesTransactionVoided{TransactionID: 11, FinalAmount: 27, VoucherID: &voucherID},
+	}
+}
+
+func TestEveryTypeRoundTrips(t *testing.T) {
+	samples := samples()
+	for _, eventType := range Default.Types() {
+		sample, exists := samples[eventType]
+		if !exists {
+			t.Errorf("%s has no sample payload", eventType)
+			continue
+		}
+
+		version, data, err := Default.Encode(sample)
+		if err != nil {
+			t.Errorf("Encode(%s): %v", eventType, err)
+			continue
+		}
+		decoded, err := Default.Decode(eventType, version, data)
+		if err != nil {
+			t.Errorf("Decode(%s, %d, %s): %v", eventType, version, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, sample) {
+			t.Errorf("%s decoded as %+v, want %+v", eventType, decoded, sample)
+		}
+	}
+}
+
+func TestOrderCreatedV1IsUpcast(t *testing.T) {
+	decoded, err := Default.Decode(TypeOrderCreated, 1, []byte(`{"customer_id":7,"total_amount":30}`))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	want := &OrderCreated{CustomerID: 7, TotalAmount: 30, Items: []OrderLine{}}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Fatalf("decoded %+v, want %+v", decoded, want)
+	}
+
+	// Producers that predate versioning send no version, which is read as version 1
+	if _, err := Default.Decode(TypeOrderCreated, 0, []byte(`{"customer_id":7,"total_amount":30}`)); err != nil {
+		t.Fatalf("Decode without a version: %v", err)
+	}
+}
+
+func TestDecodeRejectsUnknownFields(t *testing.T) {
+	_, err := Default.Decode(TypeReservationExpired, 1, []byte(`{"reason":"stock reservation expired","refund":true}`))
+	if !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("Decode returned %v, want ErrInvalidPayload", err)
+	}
+}
+
+func TestDecodeRejectsUnknownTypeAndNewerVersion(t *testing.T) {
+	if _, err := Default.Decode("ORDER_SHIPPED", 1, []byte(`{}`)); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Decode of an unknown type returned %v, want ErrUnknownType", err)
+	}
+	if _, err := Default.Decode(TypeOrderCreated, 3, []byte(`{}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Decode of a newer version returned %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestAmountAcceptsNumericStrings(t *testing.T) {
+	decoded, err := Default.Decode(TypeSalesTransactionCompleted, 1,
+		[]byte(`{"transaction_id":11,"final_amount":"27.50","discount_amount":2.5}`))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	completed := decoded.(*SalesTransactionCompleted)
+	if completed.FinalAmount != 27.5 || completed.DiscountAmount != 2.5 {
+		t.Fatalf("decoded %+v, want amounts 27.5 and 2.5", completed)
+	}
+}
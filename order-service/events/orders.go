@@ -0,0 +1,62 @@
+package events
+
+import "encoding/json"
+
+// OrderCreated is published when an order is placed and its stock is held.
+// Version 2 added Items; version 1 events are upcast with no items.
+type OrderCreated struct {
+	CustomerID  int         `json:"customer_id"`
+	TotalAmount float64     `json:"total_amount"`
+	Items       []OrderLine `json:"items"`
+}
+
+type OrderLine struct {
+	ProductID int     `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	Price     float64 `json:"price"`
+}
+
+func (OrderCreated) EventType() string { return TypeOrderCreated }
+
+func upcastOrderCreatedV1(data json.RawMessage) (json.RawMessage, error) {
+	var v1 map[string]json.RawMessage
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return nil, err
+	}
+	v1["items"] = json.RawMessage("[]")
+	return json.Marshal(v1)
+}
+
+// ReservationExpired is published when the sweeper cancels an order whose stock hold ran out
+type ReservationExpired struct {
+	Reason string `json:"reason"`
+}
+
+func (ReservationExpired) EventType() string { return TypeReservationExpired }
+
+// ProductChanged is the catalog entry after a create, update or delete. Type says which one happened.
+type ProductChanged struct {
+	Type             string  `json:"-"`
+	ID               int     `json:"id"`
+	Name             string  `json:"name"`
+	Price            float64 `json:"price"`
+	StockQuantity    int     `json:"stock_quantity"`
+	ReservedQuantity int     `json:"reserved_quantity"`
+}
+
+func (p ProductChanged) EventType() string { return p.Type }
+
+// OrderConfirmed is published when the choreography saga confirms an order after its payment
+type OrderConfirmed struct {
+	TransactionID int    `json:"transaction_id"`
+	FinalAmount   Amount `json:"final_amount"`
+}
+
+func (OrderConfirmed) EventType() string { return TypeOrderConfirmed }
+
+// OrderCancelled is published when the choreography saga cancels an order; any charge for it must be voided
+type OrderCancelled struct {
+	Reason string `json:"reason"`
+}
+
+func (OrderCancelled) EventType() string { return TypeOrderCancelled }
@@ -0,0 +1,45 @@
+package events
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Amount is a money value. sales-service sends amounts read from NUMERIC columns as strings,
+// so both JSON numbers and numeric strings are accepted.
+type Amount float64
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	value, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return err
+	}
+	*a = Amount(value)
+	return nil
+}
+
+// SalesTransactionCompleted is published by sales-service once an order has been charged
+type SalesTransactionCompleted struct {
+	TransactionID  int    `json:"transaction_id"`
+	FinalAmount    Amount `json:"final_amount"`
+	DiscountAmount Amount `json:"discount_amount"`
+}
+
+func (SalesTransactionCompleted) EventType() string { return TypeSalesTransactionCompleted }
+
+// SalesTransactionFailed is published by sales-service when an order could not be charged
+type SalesTransactionFailed struct {
+	Error string `json:"error"`
+}
+
+func (SalesTransactionFailed) EventType() string { return TypeSalesTransactionFailed }
+
+// SalesTransactionVoided is published by sales-service when a charge is reversed
+type SalesTransactionVoided struct {
+	TransactionID int    `json:"transaction_id"`
+	FinalAmount   Amount `json:"final_amount"`
+	VoucherID     *int   `json:"voucher_id"`
+}
+
+func (SalesTransactionVoided) EventType() string { return TypeSalesTransactionVoided }
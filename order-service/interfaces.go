@@ -1,40 +1,162 @@
 package main
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
 
 // Repository interfaces
 type OrderRepository interface {
-	Create(tx *sql.Tx, order *Order) (int, error)
+	Create(tx *sql.Tx, order *Order, sagaTimeout time.Duration) (int, error)
 	GetByID(id int) (*Order, error)
-	UpdateStatus(id int, status string) error
+	List(filter OrderFilter) ([]Order, error)
+	GetStatusForUpdate(tx *sql.Tx, id int) (OrderStatus, error)
+	UpdateStatus(tx *sql.Tx, id int, status OrderStatus) error
+	GetSagaStateForUpdate(tx *sql.Tx, id int) (OrderStatus, SagaStep, error)
+	UpdateSagaStep(tx *sql.Tx, id int, step SagaStep) error
+	ListSagaTimedOut(limit int) ([]int, error)
+	RecordStatusChange(tx *sql.Tx, change *OrderStatusChange) error
+	GetStatusHistory(orderID int) ([]OrderStatusChange, error)
 }
 
 type ProductRepository interface {
 	GetAll() ([]Product, error)
-	GetByID(tx *sql.Tx, id int) (*Product, error)
-	UpdateStock(tx *sql.Tx, id, quantity int) error
+	Get(id int) (*Product, error)
+	LockByIDs(tx *sql.Tx, ids []int) (map[int]*Product, error)
+	Create(tx *sql.Tx, product *Product) error
+	Update(tx *sql.Tx, product *Product) error
+	SoftDelete(tx *sql.Tx, id int) error
+	Reserve(tx *sql.Tx, id, quantity int) error
+	ReleaseReserved(tx *sql.Tx, id, quantity int) error
+	CommitReserved(tx *sql.Tx, id, quantity int) error
+	RestoreStock(tx *sql.Tx, id, quantity int) error
+}
+
+type ReservationRepository interface {
+	Create(tx *sql.Tx, reservation *Reservation, ttl time.Duration) error
+	GetByOrderForUpdate(tx *sql.Tx, orderID int) ([]Reservation, error)
+	UpdateStatus(tx *sql.Tx, id int, status ReservationStatus) error
+	ListExpiredOrderIDs(limit int) ([]int, error)
 }
 
 type OutboxRepository interface {
 	Store(tx *sql.Tx, event *SagaEvent) error
-	GetUnprocessed() ([]OutboxEvent, error)
-	MarkProcessed(id int) error
+	Claim(owner string, lease time.Duration, limit int) ([]OutboxEvent, error)
+	MarkProcessed(id int, owner string) error
+	MarkFailed(id int, owner string, lastError string, nextAttemptAt time.Time) error
+	DeadLetter(id int, owner string, lastError string) error
+	ListDeadLetters(limit int) ([]DeadLetter, error)
+	GetDeadLetter(id int) (*DeadLetter, error)
+	Redrive(id int) error
+}
+
+type IdempotencyRepository interface {
+	Get(key string) (*IdempotencyRecord, error)
+	Store(tx *sql.Tx, record *IdempotencyRecord) error
+}
+
+type InboxRepository interface {
+	Record(tx *sql.Tx, event *SagaEvent) error
+	RecordDuplicate(eventID string) error
+	Stats() (*InboxStats, error)
+}
+
+type QuarantineRepository interface {
+	Store(message *QuarantinedMessage) error
+	List(limit int) ([]QuarantinedMessage, error)
 }
 
 // Service interfaces
 type OrderService interface {
-	CreateOrder(order *Order) (*Order, error)
+	CreateOrder(order *Order, idempotency *IdempotencyRecord) (*Order, error)
 	GetOrder(id int) (*Order, error)
-	UpdateOrderStatus(id int, status string) error
+	ListOrders(filter OrderFilter) (*OrderPage, error)
+	UpdateOrderStatus(id int, status OrderStatus, changedBy, reason string) error
+	CancelOrder(id int, changedBy, reason string) error
+	ExpireReservations(id int) error
+	ApplyEvent(event SagaEvent) error
+	TimeoutSaga(id int) error
+	GetStatusHistory(id int) ([]OrderStatusChange, error)
+}
+
+type ProductService interface {
+	GetProduct(id int) (*Product, error)
+	CreateProduct(product *Product) (*Product, error)
+	UpdateProduct(product *Product) (*Product, error)
+	DeleteProduct(id int) error
 }
 
 type SagaService interface {
-	PublishEvent(event SagaEvent)
+	PublishEvent(event SagaEvent) error
 	ProcessEvents()
+	SweepDeadlines()
+	InboxStats() (*InboxStats, error)
+	ListQuarantined(limit int) ([]QuarantinedMessage, error)
 }
 
 type OutboxService interface {
 	ProcessEvents()
+	ListDeadLetters(limit int) ([]DeadLetter, error)
+	GetDeadLetter(id int) (*DeadLetter, error)
+	RedriveDeadLetter(id int) error
+}
+
+type ReservationService interface {
+	ReleaseExpired()
+}
+
+// MessageBus carries saga events between services. Delivery is at-least-once: a message stays
+// pending for its consumer group until it is acknowledged, and may be delivered again before that.
+type MessageBus interface {
+	Publish(ctx context.Context, topic string, event SagaEvent) error
+	// Subscribe joins the consumer group and streams its messages until ctx is cancelled
+	Subscribe(ctx context.Context, topic, group string) (<-chan BusMessage, error)
+	Ack(ctx context.Context, message BusMessage) error
+}
+
+var (
+	ErrDuplicateIdempotencyKey = errors.New("idempotency key already used")
+	ErrInvalidProduct          = errors.New("invalid product")
+	ErrInvalidOrder            = errors.New("invalid order")
+	ErrProductNotFound         = errors.New("product not found")
+	ErrInsufficientStock       = errors.New("insufficient stock")
+	ErrReservationExpired      = errors.New("stock reservation expired")
+	ErrDuplicateEvent          = errors.New("event already processed")
+)
+
+// IdempotencyRecord is the stored outcome of a request sent with an Idempotency-Key header
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+}
+
+// InboxStats summarises the saga events this service has consumed
+type InboxStats struct {
+	Processed  int `json:"processed"`
+	Duplicates int `json:"duplicates"`
+}
+
+// BusMessage is one delivery of an encoded saga event to a consumer group
+type BusMessage struct {
+	ID      string
+	Topic   string
+	Group   string
+	Payload []byte
+}
+
+// QuarantinedMessage is a consumed message that could not be decoded or handled, kept as received
+type QuarantinedMessage struct {
+	ID            int       `json:"id"`
+	MessageID     string    `json:"message_id"`
+	Topic         string    `json:"topic"`
+	Payload       string    `json:"payload"`
+	Reason        string    `json:"reason"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
 }
 
 // Event types
@@ -44,4 +166,21 @@ type OutboxEvent struct {
 	EventType   string `json:"event_type"`
 	AggregateID int    `json:"aggregate_id"`
 	EventData   []byte `json:"event_data"`
+	DataVersion int    `json:"data_version"`
+	Attempts    int    `json:"attempts"`
+}
+
+// DeadLetter is an outbox event that ran out of publish attempts
+type DeadLetter struct {
+	ID             int             `json:"id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	AggregateID    int             `json:"aggregate_id"`
+	EventData      json.RawMessage `json:"event_data"`
+	DataVersion    int             `json:"data_version"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeadLetteredAt time.Time       `json:"dead_lettered_at"`
+	RedrivenAt     *time.Time      `json:"redriven_at,omitempty"`
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -12,15 +16,19 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+
+	"order-service/events"
 )
 
 type Order struct {
-	ID          int         `json:"id"`
-	CustomerID  int         `json:"customer_id"`
-	TotalAmount float64     `json:"total_amount"`
-	Status      string      `json:"status"`
-	Items       []OrderItem `json:"items"`
-	CreatedAt   time.Time   `json:"created_at"`
+	ID           int         `json:"id"`
+	CustomerID   int         `json:"customer_id"`
+	TotalAmount  float64     `json:"total_amount"`
+	Status       OrderStatus `json:"status"`
+	SagaStep     SagaStep    `json:"saga_step"`
+	SagaDeadline *time.Time  `json:"saga_deadline,omitempty"`
+	Items        []OrderItem `json:"items"`
+	CreatedAt    time.Time   `json:"created_at"`
 }
 
 type OrderItem struct {
@@ -30,26 +38,52 @@ type OrderItem struct {
 }
 
 type Product struct {
-	ID            int     `json:"id"`
-	Name          string  `json:"name"`
-	Price         float64 `json:"price"`
-	StockQuantity int     `json:"stock_quantity"`
+	ID               int     `json:"id"`
+	Name             string  `json:"name"`
+	Price            float64 `json:"price"`
+	StockQuantity    int     `json:"stock_quantity"`
+	ReservedQuantity int     `json:"reserved_quantity"`
+}
+
+type ReservationStatus string
+
+const (
+	ReservationHeld      ReservationStatus = "held"
+	ReservationCommitted ReservationStatus = "committed"
+	ReservationReleased  ReservationStatus = "released"
+)
+
+// Reservation holds stock for a pending order until it is confirmed, cancelled or expires
+type Reservation struct {
+	ID        int               `json:"id"`
+	OrderID   int               `json:"order_id"`
+	ProductID int               `json:"product_id"`
+	Quantity  int               `json:"quantity"`
+	Status    ReservationStatus `json:"status"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	// Expired is read from the database clock when the reservation is loaded
+	Expired bool `json:"-"`
 }
 
 type SagaEvent struct {
-	ID        string      `json:"id"`
-	Type      string      `json:"type"`
-	OrderID   int         `json:"order_id"`
-	Data      interface{} `json:"data"`
-	Timestamp time.Time   `json:"timestamp"`
+	Version     int            `json:"version"`
+	ID          string         `json:"id"`
+	Type        string         `json:"type"`
+	OrderID     int            `json:"order_id"`
+	DataVersion int            `json:"data_version,omitempty"`
+	Data        events.Payload `json:"data"`
+	Timestamp   time.Time      `json:"timestamp"`
 }
 
 var (
-	db            *sql.DB
-	rdb           *redis.Client
-	orderService  OrderService
-	sagaService   SagaService
-	outboxService OutboxService
+	db                 *sql.DB
+	rdb                *redis.Client
+	orderService       OrderService
+	productService     ProductService
+	sagaService        SagaService
+	outboxService      OutboxService
+	reservationService ReservationService
+	idempotencyRepo    IdempotencyRepository
 )
 
 func main() {
@@ -63,13 +97,28 @@ func main() {
 	r := gin.Default()
 
 	r.GET("/products", getProducts)
+	r.POST("/products", createProduct)
+	r.GET("/products/:id", getProduct)
+	r.PUT("/products/:id", updateProduct)
+	r.DELETE("/products/:id", deleteProduct)
+	r.GET("/orders", listOrders)
 	r.POST("/orders", createOrder)
 	r.GET("/orders/:id", getOrder)
 	r.PUT("/orders/:id/status", updateOrderStatus)
+	r.GET("/orders/:id/history", getOrderStatusHistory)
+
+	admin := r.Group("/admin")
+	admin.GET("/outbox/dead-letters", listDeadLetters)
+	admin.GET("/outbox/dead-letters/:id", getDeadLetter)
+	admin.POST("/outbox/dead-letters/:id/redrive", redriveDeadLetter)
+	admin.GET("/inbox/stats", getInboxStats)
+	admin.GET("/quarantine", listQuarantinedMessages)
 
 	// Background services
 	go sagaService.ProcessEvents()
+	go sagaService.SweepDeadlines()
 	go outboxService.ProcessEvents()
+	go reservationService.ReleaseExpired()
 
 	r.Run(":8080")
 }
@@ -78,10 +127,41 @@ func initServices() {
 	orderRepo := NewOrderRepository(db)
 	productRepo := NewProductRepository(db)
 	outboxRepo := NewOutboxRepository(db)
+	reservationRepo := NewReservationRepository(db)
+	idempotencyRepo = NewIdempotencyRepository(db)
+	inboxRepo := NewInboxRepository(db)
+
+	reservationTTL := getEnvDuration("RESERVATION_TTL", 15*time.Minute)
+	sagaTimeout := getEnvDuration("SAGA_PAYMENT_TIMEOUT", 5*time.Minute)
+	sagaSweepInterval := getEnvDuration("SAGA_SWEEP_INTERVAL", 30*time.Second)
+	sweepInterval := getEnvDuration("RESERVATION_SWEEP_INTERVAL", 30*time.Second)
 
-	orderService = NewOrderService(orderRepo, productRepo, outboxRepo, db)
-	sagaService = NewSagaService(rdb, orderRepo, productRepo)
-	outboxService = NewOutboxService(outboxRepo, sagaService)
+	orderService = NewOrderService(orderRepo, productRepo, outboxRepo, reservationRepo, idempotencyRepo, inboxRepo, reservationTTL, sagaTimeout, db)
+	productService = NewProductService(productRepo, outboxRepo, db)
+	bus := newMessageBus()
+	sagaService = NewSagaService(bus, orderService, orderRepo, productRepo, inboxRepo, NewQuarantineRepository(db), sagaSweepInterval)
+	outboxService = NewOutboxService(outboxRepo, bus, OutboxRetryPolicy{
+		MaxAttempts: getEnvInt("OUTBOX_MAX_ATTEMPTS", 10),
+		BaseDelay:   getEnvDuration("OUTBOX_RETRY_BASE_DELAY", time.Second),
+		MaxDelay:    getEnvDuration("OUTBOX_RETRY_MAX_DELAY", 5*time.Minute),
+	})
+	reservationService = NewReservationService(reservationRepo, orderService, sweepInterval)
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
 }
 
 func initDB() {
@@ -111,6 +191,19 @@ func initRedis() {
 	})
 }
 
+// newMessageBus picks the saga transport; MESSAGE_BUS=memory keeps messages inside this process
+func newMessageBus() MessageBus {
+	if os.Getenv("MESSAGE_BUS") == "memory" {
+		return NewChannelMessageBus(getEnvDuration("SAGA_STREAM_CLAIM_MIN_IDLE", time.Minute))
+	}
+	return NewRedisMessageBus(rdb, SagaStreamConfig{
+		MaxLen:       int64(getEnvInt("SAGA_STREAM_MAXLEN", 10000)),
+		ClaimMinIdle: getEnvDuration("SAGA_STREAM_CLAIM_MIN_IDLE", time.Minute),
+		BatchSize:    50,
+		Block:        5 * time.Second,
+	})
+}
+
 func getProducts(c *gin.Context) {
 	productRepo := NewProductRepository(db)
 	products, err := productRepo.GetAll()
@@ -128,15 +221,229 @@ func createOrder(c *gin.Context) {
 		return
 	}
 
-	createdOrder, err := orderService.CreateOrder(&order)
+	var idempotency *IdempotencyRecord
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		requestHash := hashRequest(order)
+		if replayIdempotentResponse(c, key, requestHash) {
+			return
+		}
+		idempotency = &IdempotencyRecord{Key: key, RequestHash: requestHash}
+	}
+
+	createdOrder, err := orderService.CreateOrder(&order, idempotency)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, ErrDuplicateIdempotencyKey):
+			// Lost the race on the idempotency key; the other order is the answer to this request too
+			replayIdempotentResponse(c, idempotency.Key, idempotency.RequestHash)
+		case errors.Is(err, ErrInvalidOrder), errors.Is(err, ErrProductNotFound):
+			c.JSON(400, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrInsufficientStock):
+			c.JSON(409, gin.H{"error": err.Error()})
+		default:
+			c.JSON(500, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
 	c.JSON(201, createdOrder)
 }
 
+// replayIdempotentResponse writes the stored response for key and reports whether the request was handled
+func replayIdempotentResponse(c *gin.Context, key, requestHash string) bool {
+	record, err := idempotencyRepo.Get(key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return true
+	}
+
+	if record.RequestHash != requestHash {
+		c.JSON(422, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		return true
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(record.StatusCode, "application/json; charset=utf-8", record.Response)
+	return true
+}
+
+func hashRequest(request interface{}) string {
+	body, _ := json.Marshal(request)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func getProduct(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	product, err := productService.GetProduct(id)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Product not found"})
+		return
+	}
+
+	c.JSON(200, product)
+}
+
+func createProduct(c *gin.Context) {
+	var product Product
+	if err := c.ShouldBindJSON(&product); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	createdProduct, err := productService.CreateProduct(&product)
+	if err != nil {
+		respondProductError(c, err)
+		return
+	}
+
+	c.JSON(201, createdProduct)
+}
+
+func updateProduct(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var product Product
+	if err := c.ShouldBindJSON(&product); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	product.ID = id
+
+	updatedProduct, err := productService.UpdateProduct(&product)
+	if err != nil {
+		respondProductError(c, err)
+		return
+	}
+
+	c.JSON(200, updatedProduct)
+}
+
+func deleteProduct(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := productService.DeleteProduct(id); err != nil {
+		respondProductError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Product deleted"})
+}
+
+func respondProductError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidProduct):
+		c.JSON(400, gin.H{"error": err.Error()})
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(404, gin.H{"error": "Product not found"})
+	default:
+		c.JSON(500, gin.H{"error": err.Error()})
+	}
+}
+
+func listOrders(c *gin.Context) {
+	filter, err := parseOrderFilter(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := orderService.ListOrders(filter)
+	if errors.Is(err, ErrInvalidCursor) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, page)
+}
+
+func parseOrderFilter(c *gin.Context) (OrderFilter, error) {
+	var filter OrderFilter
+	var err error
+
+	if value := c.Query("customer_id"); value != "" {
+		if filter.CustomerID, err = strconv.Atoi(value); err != nil {
+			return filter, fmt.Errorf("invalid customer_id: %v", err)
+		}
+	}
+	if value := c.Query("status"); value != "" {
+		filter.Status = OrderStatus(value)
+		if !filter.Status.Valid() {
+			return filter, fmt.Errorf("%w: %q", ErrUnknownOrderStatus, value)
+		}
+	}
+	if filter.CreatedFrom, err = parseTimeQuery(c, "created_from"); err != nil {
+		return filter, err
+	}
+	if filter.CreatedTo, err = parseTimeQuery(c, "created_to"); err != nil {
+		return filter, err
+	}
+	if filter.MinTotal, err = parseAmountQuery(c, "min_total"); err != nil {
+		return filter, err
+	}
+	if filter.MaxTotal, err = parseAmountQuery(c, "max_total"); err != nil {
+		return filter, err
+	}
+
+	filter.SortBy = c.DefaultQuery("sort", "created_at")
+	if _, ok := orderSortColumns[filter.SortBy]; !ok {
+		return filter, fmt.Errorf("invalid sort: %q", filter.SortBy)
+	}
+	switch c.DefaultQuery("order", "desc") {
+	case "desc":
+		filter.Descending = true
+	case "asc":
+	default:
+		return filter, fmt.Errorf("invalid order: %q", c.Query("order"))
+	}
+
+	if value := c.Query("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			return filter, fmt.Errorf("invalid limit: %v", err)
+		}
+	}
+	if value := c.Query("cursor"); value != "" {
+		if filter.Cursor, err = DecodeOrderCursor(value); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+func parseTimeQuery(c *gin.Context, name string) (*time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	// created_at is a TIMESTAMP without time zone holding UTC, which would drop the offset instead of applying it
+	t = t.UTC()
+	return &t, nil
+}
+
+func parseAmountQuery(c *gin.Context, name string) (*float64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return &amount, nil
+}
+
 func getOrder(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
 
@@ -152,7 +459,9 @@ func getOrder(c *gin.Context) {
 func updateOrderStatus(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
 	var req struct {
-		Status string `json:"status"`
+		Status    string `json:"status"`
+		ChangedBy string `json:"changed_by"`
+		Reason    string `json:"reason"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -160,11 +469,113 @@ func updateOrderStatus(c *gin.Context) {
 		return
 	}
 
-	err := orderService.UpdateOrderStatus(id, req.Status)
+	if req.ChangedBy == "" {
+		req.ChangedBy = "api"
+	}
+
+	err := orderService.UpdateOrderStatus(id, OrderStatus(req.Status), req.ChangedBy, req.Reason)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		var transitionErr *InvalidTransitionError
+		switch {
+		case errors.Is(err, ErrUnknownOrderStatus):
+			c.JSON(400, gin.H{"error": err.Error()})
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(404, gin.H{"error": "Order not found"})
+		case errors.As(err, &transitionErr):
+			c.JSON(409, gin.H{"error": err.Error(), "current_status": transitionErr.Current})
+		case errors.Is(err, ErrReservationExpired):
+			c.JSON(409, gin.H{"error": err.Error()})
+		default:
+			c.JSON(500, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
 	c.JSON(200, gin.H{"message": "Order status updated"})
 }
+
+func getOrderStatusHistory(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	history, err := orderService.GetStatusHistory(id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, history)
+}
+
+func listDeadLetters(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	deadLetters, err := outboxService.ListDeadLetters(limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, deadLetters)
+}
+
+func getDeadLetter(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	deadLetter, err := outboxService.GetDeadLetter(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, deadLetter)
+}
+
+func redriveDeadLetter(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := outboxService.RedriveDeadLetter(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Dead letter not found or already re-driven"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Dead letter re-driven"})
+}
+
+func getInboxStats(c *gin.Context) {
+	stats, err := sagaService.InboxStats()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, stats)
+}
+
+func listQuarantinedMessages(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	messages, err := sagaService.ListQuarantined(limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, messages)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ChannelMessageBus implements MessageBus in process. Like a Redis consumer group, each group on a
+// topic receives every message published after it subscribed, and holds it as pending until acked.
+// A message left pending for longer than claimMinIdle is delivered again.
+type ChannelMessageBus struct {
+	claimMinIdle time.Duration
+
+	mu     sync.Mutex
+	nextID int
+	groups map[string]map[string]*memoryGroup
+}
+
+type memoryGroup struct {
+	queue   []BusMessage
+	pending map[string]*pendingMessage
+	// notify wakes the group's delivery goroutine when queue grows
+	notify chan struct{}
+}
+
+type pendingMessage struct {
+	message     BusMessage
+	deliveredAt time.Time
+}
+
+func NewChannelMessageBus(claimMinIdle time.Duration) *ChannelMessageBus {
+	return &ChannelMessageBus{claimMinIdle: claimMinIdle, groups: make(map[string]map[string]*memoryGroup)}
+}
+
+// next picks the message to deliver now: the longest idle pending message that is due again, or else the
+// first queued one. With nothing to deliver it returns how long until a pending message is due, or 0
+// if none is pending. b.mu must be held.
+func (g *memoryGroup) next(now time.Time, claimMinIdle time.Duration) (*BusMessage, time.Duration) {
+	var oldest *pendingMessage
+	for _, pending := range g.pending {
+		if oldest == nil || pending.deliveredAt.Before(oldest.deliveredAt) {
+			oldest = pending
+		}
+	}
+	if oldest != nil && now.Sub(oldest.deliveredAt) >= claimMinIdle {
+		oldest.deliveredAt = now
+		message := oldest.message
+		return &message, 0
+	}
+
+	if len(g.queue) > 0 {
+		message := g.queue[0]
+		g.queue = g.queue[1:]
+		g.pending[message.ID] = &pendingMessage{message: message, deliveredAt: now}
+		return &message, 0
+	}
+
+	if oldest != nil {
+		return nil, oldest.deliveredAt.Add(claimMinIdle).Sub(now)
+	}
+	return nil, 0
+}
+
+func (b *ChannelMessageBus) Publish(ctx context.Context, topic string, event SagaEvent) error {
+	payload, err := encodeSagaEvent(event)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	id := strconv.Itoa(b.nextID)
+	for name, group := range b.groups[topic] {
+		group.queue = append(group.queue, BusMessage{ID: id, Topic: topic, Group: name, Payload: payload})
+		select {
+		case group.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *ChannelMessageBus) Subscribe(ctx context.Context, topic, group string) (<-chan BusMessage, error) {
+	b.mu.Lock()
+	if b.groups[topic] == nil {
+		b.groups[topic] = make(map[string]*memoryGroup)
+	}
+	g, exists := b.groups[topic][group]
+	if !exists {
+		g = &memoryGroup{pending: make(map[string]*pendingMessage), notify: make(chan struct{}, 1)}
+		b.groups[topic][group] = g
+	}
+	b.mu.Unlock()
+
+	messages := make(chan BusMessage)
+	go func() {
+		defer close(messages)
+		for {
+			b.mu.Lock()
+			next, wait := g.next(time.Now(), b.claimMinIdle)
+			b.mu.Unlock()
+
+			if next == nil {
+				// A zero wait leaves due nil, so only a new message or cancellation wakes the loop
+				var due <-chan time.Time
+				var timer *time.Timer
+				if wait > 0 {
+					timer = time.NewTimer(wait)
+					due = timer.C
+				}
+				select {
+				case <-g.notify:
+				case <-due:
+				case <-ctx.Done():
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+
+			select {
+			case messages <- *next:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+func (b *ChannelMessageBus) Ack(ctx context.Context, message BusMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g, exists := b.groups[message.Topic][message.Group]
+	if !exists {
+		return fmt.Errorf("unknown consumer group %s on %s", message.Group, message.Topic)
+	}
+	if _, pending := g.pending[message.ID]; !pending {
+		return fmt.Errorf("message %s is not pending for %s", message.ID, message.Group)
+	}
+	delete(g.pending, message.ID)
+	return nil
+}
+
+// Pending returns the messages a group has received but not acknowledged yet
+func (b *ChannelMessageBus) Pending(topic, group string) []BusMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var pending []BusMessage
+	if g, exists := b.groups[topic][group]; exists {
+		for _, message := range g.pending {
+			pending = append(pending, message.message)
+		}
+	}
+	return pending
+}
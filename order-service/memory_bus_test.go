@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"order-service/events"
+)
+
+func receive(t *testing.T, messages <-chan BusMessage) BusMessage {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+		return BusMessage{}
+	}
+}
+
+func TestChannelMessageBusRedeliversUnackedMessages(t *testing.T) {
+	bus := NewChannelMessageBus(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := bus.Subscribe(ctx, sagaResponsesStream, sagaConsumerGroup)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	event := newSagaEvent(1, &events.SalesTransactionFailed{Error: "card declined"})
+	if err := bus.Publish(ctx, sagaResponsesStream, *event); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	first := receive(t, messages)
+	redelivered := receive(t, messages)
+	if redelivered.ID != first.ID {
+		t.Fatalf("redelivered message %s, want %s", redelivered.ID, first.ID)
+	}
+
+	if err := bus.Ack(ctx, redelivered); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if pending := bus.Pending(sagaResponsesStream, sagaConsumerGroup); len(pending) != 0 {
+		t.Fatalf("%d messages still pending after ack", len(pending))
+	}
+	select {
+	case message := <-messages:
+		t.Fatalf("acked message %s was delivered again", message.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestChannelMessageBusRedeliversToNewSubscription(t *testing.T) {
+	bus := NewChannelMessageBus(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	messages, err := bus.Subscribe(ctx, sagaResponsesStream, sagaConsumerGroup)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	event := newSagaEvent(1, &events.SalesTransactionFailed{Error: "card declined"})
+	if err := bus.Publish(context.Background(), sagaResponsesStream, *event); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	lost := receive(t, messages)
+
+	// The consumer stops before acking, as a crashed process would
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	messages, err = bus.Subscribe(ctx, sagaResponsesStream, sagaConsumerGroup)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if redelivered := receive(t, messages); redelivered.ID != lost.ID {
+		t.Fatalf("redelivered message %s, want %s", redelivered.ID, lost.ID)
+	}
+}
+
+// flakyOrderService fails the first failures calls of ApplyEvent and records the events it applied
+type flakyOrderService struct {
+	OrderService
+
+	mu       sync.Mutex
+	failures int
+	applied  []string
+}
+
+func (s *flakyOrderService) ApplyEvent(event SagaEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("connection reset by peer")
+	}
+	for _, id := range s.applied {
+		if id == event.ID {
+			return ErrDuplicateEvent
+		}
+	}
+	s.applied = append(s.applied, event.ID)
+	return nil
+}
+
+func (s *flakyOrderService) appliedEvents() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.applied...)
+}
+
+type countingInbox struct {
+	InboxRepository
+
+	mu         sync.Mutex
+	duplicates int
+}
+
+func (r *countingInbox) RecordDuplicate(eventID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.duplicates++
+	return nil
+}
+
+// waitUntil polls condition until it holds or five seconds have passed
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A sales-service response whose handling fails is left pending and applied once it is redelivered
+func TestSagaServiceAppliesRedeliveredResponses(t *testing.T) {
+	bus := NewChannelMessageBus(50 * time.Millisecond)
+	orderService := &flakyOrderService{failures: 2}
+	saga := &SagaServiceImpl{bus: bus, orderService: orderService, inboxRepo: &countingInbox{}}
+	go saga.ProcessEvents()
+
+	waitUntil(t, "the saga service subscribed", func() bool {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		return bus.groups[sagaResponsesStream][sagaConsumerGroup] != nil
+	})
+
+	completed := newSagaEvent(1, &events.SalesTransactionCompleted{TransactionID: 11, FinalAmount: 27})
+	if err := bus.Publish(context.Background(), sagaResponsesStream, *completed); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	failed := newSagaEvent(2, &events.SalesTransactionFailed{Error: "card declined"})
+	if err := bus.Publish(context.Background(), sagaResponsesStream, *failed); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	waitUntil(t, "every message was applied and acked", func() bool {
+		return len(bus.Pending(sagaResponsesStream, sagaConsumerGroup)) == 0 && len(orderService.appliedEvents()) == 2
+	})
+	applied := orderService.appliedEvents()
+	if (applied[0] != completed.ID || applied[1] != failed.ID) && (applied[0] != failed.ID || applied[1] != completed.ID) {
+		t.Fatalf("applied %v, want %s and %s once each", applied, completed.ID, failed.ID)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// orderSortColumns maps the sort names accepted by GET /orders to their columns
+var orderSortColumns = map[string]string{
+	"created_at":   "created_at",
+	"total_amount": "total_amount",
+}
+
+// OrderFilter selects a page of orders; zero values mean "no filter"
+type OrderFilter struct {
+	CustomerID  int
+	Status      OrderStatus
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	MinTotal    *float64
+	MaxTotal    *float64
+	SortBy      string
+	Descending  bool
+	Cursor      *OrderCursor
+	Limit       int
+}
+
+// OrderCursor is the sort key of the last order on a page; the next page starts after it.
+// It is only valid for the sort column and direction it was issued for.
+type OrderCursor struct {
+	SortBy      string    `json:"sort_by"`
+	Descending  bool      `json:"descending"`
+	CreatedAt   time.Time `json:"created_at"`
+	TotalAmount float64   `json:"total_amount"`
+	ID          int       `json:"id"`
+}
+
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+func newOrderCursor(filter OrderFilter, order Order) *OrderCursor {
+	return &OrderCursor{
+		SortBy:      filter.SortBy,
+		Descending:  filter.Descending,
+		CreatedAt:   order.CreatedAt.UTC(),
+		TotalAmount: order.TotalAmount,
+		ID:          order.ID,
+	}
+}
+
+// sortValue returns the cursor's value for the column the page is sorted by
+func (c *OrderCursor) sortValue() interface{} {
+	if c.SortBy == "total_amount" {
+		return c.TotalAmount
+	}
+	return c.CreatedAt
+}
+
+func (c *OrderCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeOrderCursor(encoded string) (*OrderCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor OrderCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if _, ok := orderSortColumns[cursor.SortBy]; !ok {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
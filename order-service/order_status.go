@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type OrderStatus string
+
+const (
+	OrderStatusPending   OrderStatus = "pending"
+	OrderStatusConfirmed OrderStatus = "confirmed"
+	OrderStatusCompleted OrderStatus = "completed"
+	OrderStatusCancelled OrderStatus = "cancelled"
+	OrderStatusRefunded  OrderStatus = "refunded"
+)
+
+// orderTransitions lists the statuses each status may move to; statuses without an entry are final
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPending:   {OrderStatusConfirmed, OrderStatusCompleted, OrderStatusCancelled},
+	OrderStatusConfirmed: {OrderStatusCompleted, OrderStatusCancelled},
+	OrderStatusCompleted: {OrderStatusRefunded},
+	OrderStatusCancelled: {},
+	OrderStatusRefunded:  {},
+}
+
+var ErrUnknownOrderStatus = errors.New("unknown order status")
+
+func (s OrderStatus) Valid() bool {
+	_, exists := orderTransitions[s]
+	return exists
+}
+
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidTransitionError is returned when an order cannot move from its current status to the requested one
+type InvalidTransitionError struct {
+	Current   OrderStatus
+	Requested OrderStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot change order status from %s to %s", e.Current, e.Requested)
+}
+
+// OrderStatusChange is one recorded transition of an order
+type OrderStatusChange struct {
+	OrderID    int         `json:"order_id"`
+	FromStatus OrderStatus `json:"from_status"`
+	ToStatus   OrderStatus `json:"to_status"`
+	ChangedBy  string      `json:"changed_by"`
+	Reason     string      `json:"reason"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	sagaEventsStream    = "saga_events"
+	sagaResponsesStream = "saga_responses"
+	sagaConsumerGroup   = "order-service"
+	// sagaEventField is the stream entry field that holds the JSON encoded SagaEvent
+	sagaEventField = "event"
+)
+
+// SagaStreamConfig controls how saga messages are written to and read from Redis Streams
+type SagaStreamConfig struct {
+	// MaxLen caps each stream at roughly this many entries
+	MaxLen int64
+	// ClaimMinIdle is how long an entry may stay unacknowledged before another consumer reclaims it
+	ClaimMinIdle time.Duration
+	BatchSize    int64
+	Block        time.Duration
+}
+
+// RedisMessageBus implements MessageBus with one Redis stream per topic and a consumer group per service
+type RedisMessageBus struct {
+	rdb      *redis.Client
+	config   SagaStreamConfig
+	consumer string
+}
+
+func NewRedisMessageBus(rdb *redis.Client, config SagaStreamConfig) MessageBus {
+	hostname, _ := os.Hostname()
+	return &RedisMessageBus{
+		rdb:      rdb,
+		config:   config,
+		consumer: fmt.Sprintf("%s-%s", hostname, uuid.New().String()),
+	}
+}
+
+func (b *RedisMessageBus) Publish(ctx context.Context, topic string, event SagaEvent) error {
+	eventJSON, err := encodeSagaEvent(event)
+	if err != nil {
+		return err
+	}
+	return b.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: topic,
+		MaxLen: b.config.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{sagaEventField: string(eventJSON)},
+	}).Err()
+}
+
+// Subscribe first hands out entries other consumers left unacknowledged for longer than ClaimMinIdle,
+// then new entries, and keeps doing both until ctx is cancelled.
+func (b *RedisMessageBus) Subscribe(ctx context.Context, topic, group string) (<-chan BusMessage, error) {
+	if err := b.ensureGroup(ctx, topic, group); err != nil {
+		return nil, err
+	}
+
+	messages := make(chan BusMessage)
+	go func() {
+		defer close(messages)
+
+		deliver := func(entries []redis.XMessage) bool {
+			for _, entry := range entries {
+				select {
+				case messages <- BusMessage{ID: entry.ID, Topic: topic, Group: group, Payload: entryPayload(entry)}:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		}
+
+		claimCursor := "0-0"
+		for ctx.Err() == nil {
+			claimed, next, err := b.autoClaim(ctx, topic, group, claimCursor)
+			if err != nil {
+				log.Printf("Failed to reclaim pending saga messages on %s: %v", topic, err)
+			} else {
+				claimCursor = next
+				if !deliver(claimed) {
+					return
+				}
+			}
+
+			streams, err := b.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    group,
+				Consumer: b.consumer,
+				Streams:  []string{topic, ">"},
+				Count:    b.config.BatchSize,
+				Block:    b.config.Block,
+			}).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Failed to read saga messages from %s: %v", topic, err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+
+			for _, stream := range streams {
+				if !deliver(stream.Messages) {
+					return
+				}
+			}
+		}
+	}()
+	return messages, nil
+}
+
+func (b *RedisMessageBus) Ack(ctx context.Context, message BusMessage) error {
+	return b.rdb.XAck(ctx, message.Topic, message.Group, message.ID).Err()
+}
+
+// ensureGroup creates the group at the end of the stream, creating the stream too if needed
+func (b *RedisMessageBus) ensureGroup(ctx context.Context, topic, group string) error {
+	err := b.rdb.XGroupCreateMkStream(ctx, topic, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// autoClaim runs XAUTOCLAIM and returns the reclaimed entries and the cursor for the next call.
+// The command is sent raw because Redis 7 replies with a third element the client library cannot parse.
+func (b *RedisMessageBus) autoClaim(ctx context.Context, topic, group, start string) ([]redis.XMessage, string, error) {
+	reply, err := b.rdb.Do(ctx, "XAUTOCLAIM", topic, group, b.consumer,
+		b.config.ClaimMinIdle.Milliseconds(), start, "COUNT", b.config.BatchSize).Slice()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(reply) < 2 {
+		return nil, "", fmt.Errorf("unexpected XAUTOCLAIM reply of %d elements", len(reply))
+	}
+
+	next, _ := reply[0].(string)
+	entries, _ := reply[1].([]interface{})
+	messages := make([]redis.XMessage, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) != 2 {
+			// Entries deleted from the stream while pending come back empty
+			continue
+		}
+		id, _ := fields[0].(string)
+		values, _ := fields[1].([]interface{})
+		message := redis.XMessage{ID: id, Values: make(map[string]interface{}, len(values)/2)}
+		for i := 0; i+1 < len(values); i += 2 {
+			key, _ := values[i].(string)
+			message.Values[key] = values[i+1]
+		}
+		messages = append(messages, message)
+	}
+	return messages, next, nil
+}
+
+// entryPayload returns the encoded event of a stream entry. An entry written without the event field
+// is returned whole, so the consumer rejects it with everything it contained.
+func entryPayload(entry redis.XMessage) []byte {
+	if payload, ok := entry.Values[sagaEventField].(string); ok {
+		return []byte(payload)
+	}
+	payload, _ := json.Marshal(entry.Values)
+	return payload
+}
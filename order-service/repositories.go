@@ -2,7 +2,14 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"order-service/events"
 )
 
 // OrderRepositoryImpl implements OrderRepository
@@ -14,25 +21,237 @@ func NewOrderRepository(db *sql.DB) OrderRepository {
 	return &OrderRepositoryImpl{db: db}
 }
 
-func (r *OrderRepositoryImpl) Create(tx *sql.Tx, order *Order) (int, error) {
+// Create stores the order with a saga deadline sagaTimeout after the database clock's current time, the clock the
+// timeout sweep compares it with
+func (r *OrderRepositoryImpl) Create(tx *sql.Tx, order *Order, sagaTimeout time.Duration) (int, error) {
 	var orderID int
-	err := tx.QueryRow("INSERT INTO orders (customer_id, total_amount, status) VALUES ($1, $2, 'pending') RETURNING id",
-		order.CustomerID, order.TotalAmount).Scan(&orderID)
-	return orderID, err
+	var sagaDeadline time.Time
+	err := tx.QueryRow(`INSERT INTO orders (customer_id, total_amount, status, saga_step, saga_deadline)
+		VALUES ($1, $2, 'pending', $3, CURRENT_TIMESTAMP + make_interval(secs => $4)) RETURNING id, saga_deadline`,
+		order.CustomerID, order.TotalAmount, order.SagaStep, sagaTimeout.Seconds()).Scan(&orderID, &sagaDeadline)
+	if err != nil {
+		return 0, err
+	}
+	order.SagaDeadline = &sagaDeadline
+	return orderID, nil
 }
 
+// GetByID loads the order and its line items in one query
 func (r *OrderRepositoryImpl) GetByID(id int) (*Order, error) {
-	var order Order
-	err := r.db.QueryRow("SELECT id, customer_id, total_amount, status, created_at FROM orders WHERE id = $1", id).
-		Scan(&order.ID, &order.CustomerID, &order.TotalAmount, &order.Status, &order.CreatedAt)
-	return &order, err
+	rows, err := r.db.Query(`SELECT o.id, o.customer_id, o.total_amount, o.status, o.saga_step, o.saga_deadline, o.created_at,
+		oi.product_id, oi.quantity, oi.price
+		FROM orders o LEFT JOIN order_items oi ON oi.order_id = o.id
+		WHERE o.id = $1 ORDER BY oi.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var order *Order
+	for rows.Next() {
+		var o Order
+		var productID, quantity sql.NullInt64
+		var price sql.NullFloat64
+		var sagaDeadline sql.NullTime
+		err := rows.Scan(&o.ID, &o.CustomerID, &o.TotalAmount, &o.Status, &o.SagaStep, &sagaDeadline, &o.CreatedAt, &productID, &quantity, &price)
+		if err != nil {
+			return nil, err
+		}
+		if sagaDeadline.Valid {
+			o.SagaDeadline = &sagaDeadline.Time
+		}
+
+		if order == nil {
+			o.Items = []OrderItem{}
+			order = &o
+		}
+		if productID.Valid {
+			order.Items = append(order.Items, OrderItem{
+				ProductID: int(productID.Int64),
+				Quantity:  int(quantity.Int64),
+				Price:     price.Float64,
+			})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if order == nil {
+		return nil, sql.ErrNoRows
+	}
+	return order, nil
+}
+
+// List returns up to filter.Limit orders matching the filter, ordered by the sort column and id so that
+// the cursor condition can seek past the previous page without an OFFSET
+func (r *OrderRepositoryImpl) List(filter OrderFilter) ([]Order, error) {
+	column := orderSortColumns[filter.SortBy]
+	direction, comparison := "ASC", ">"
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.CustomerID != 0 {
+		addCondition("customer_id = $%d", filter.CustomerID)
+	}
+	if filter.Status != "" {
+		addCondition("status = $%d", filter.Status)
+	}
+	if filter.CreatedFrom != nil {
+		addCondition("created_at >= $%d", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		addCondition("created_at < $%d", *filter.CreatedTo)
+	}
+	if filter.MinTotal != nil {
+		addCondition("total_amount >= $%d", *filter.MinTotal)
+	}
+	if filter.MaxTotal != nil {
+		addCondition("total_amount <= $%d", *filter.MaxTotal)
+	}
+	if filter.Cursor != nil {
+		args = append(args, filter.Cursor.sortValue(), filter.Cursor.ID)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, comparison, len(args)-1, len(args)))
+	}
+
+	query := "SELECT id, customer_id, total_amount, status, saga_step, saga_deadline, created_at FROM orders"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column, direction, direction, len(args))
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	var orderIDs []int64
+	for rows.Next() {
+		var order Order
+		var sagaDeadline sql.NullTime
+		err := rows.Scan(&order.ID, &order.CustomerID, &order.TotalAmount, &order.Status, &order.SagaStep, &sagaDeadline, &order.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if sagaDeadline.Valid {
+			order.SagaDeadline = &sagaDeadline.Time
+		}
+		order.Items = []OrderItem{}
+		orders = append(orders, order)
+		orderIDs = append(orderIDs, int64(order.ID))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return orders, nil
+	}
+
+	// Items for the whole page are loaded in one batched query
+	itemRows, err := r.db.Query("SELECT order_id, product_id, quantity, price FROM order_items WHERE order_id = ANY($1) ORDER BY id", pq.Array(orderIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	positions := make(map[int]int, len(orders))
+	for i, order := range orders {
+		positions[order.ID] = i
+	}
+	for itemRows.Next() {
+		var orderID int
+		var item OrderItem
+		if err := itemRows.Scan(&orderID, &item.ProductID, &item.Quantity, &item.Price); err != nil {
+			return nil, err
+		}
+		order := &orders[positions[orderID]]
+		order.Items = append(order.Items, item)
+	}
+	return orders, itemRows.Err()
+}
+
+// GetStatusForUpdate locks the order row so concurrent status changes are applied one at a time
+func (r *OrderRepositoryImpl) GetStatusForUpdate(tx *sql.Tx, id int) (OrderStatus, error) {
+	var status OrderStatus
+	err := tx.QueryRow("SELECT status FROM orders WHERE id = $1 FOR UPDATE", id).Scan(&status)
+	return status, err
+}
+
+// GetSagaStateForUpdate locks the order row like GetStatusForUpdate and also returns its saga step
+func (r *OrderRepositoryImpl) GetSagaStateForUpdate(tx *sql.Tx, id int) (OrderStatus, SagaStep, error) {
+	var status OrderStatus
+	var step SagaStep
+	err := tx.QueryRow("SELECT status, saga_step FROM orders WHERE id = $1 FOR UPDATE", id).Scan(&status, &step)
+	return status, step, err
+}
+
+func (r *OrderRepositoryImpl) UpdateSagaStep(tx *sql.Tx, id int, step SagaStep) error {
+	_, err := tx.Exec("UPDATE orders SET saga_step = $1 WHERE id = $2", step, id)
+	return err
 }
 
-func (r *OrderRepositoryImpl) UpdateStatus(id int, status string) error {
-	_, err := r.db.Exec("UPDATE orders SET status = $1 WHERE id = $2", status, id)
+// ListSagaTimedOut returns pending orders still waiting for sales-service after their saga deadline
+func (r *OrderRepositoryImpl) ListSagaTimedOut(limit int) ([]int, error) {
+	rows, err := r.db.Query(`SELECT id FROM orders
+		WHERE saga_step = $1 AND status = $2 AND saga_deadline < CURRENT_TIMESTAMP
+		ORDER BY saga_deadline LIMIT $3`, SagaStepAwaitingPayment, OrderStatusPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orderIDs []int
+	for rows.Next() {
+		var orderID int
+		if err := rows.Scan(&orderID); err != nil {
+			return nil, err
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	return orderIDs, rows.Err()
+}
+
+func (r *OrderRepositoryImpl) UpdateStatus(tx *sql.Tx, id int, status OrderStatus) error {
+	_, err := tx.Exec("UPDATE orders SET status = $1 WHERE id = $2", status, id)
 	return err
 }
 
+func (r *OrderRepositoryImpl) RecordStatusChange(tx *sql.Tx, change *OrderStatusChange) error {
+	_, err := tx.Exec("INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, reason) VALUES ($1, $2, $3, $4, $5)",
+		change.OrderID, change.FromStatus, change.ToStatus, change.ChangedBy, change.Reason)
+	return err
+}
+
+func (r *OrderRepositoryImpl) GetStatusHistory(orderID int) ([]OrderStatusChange, error) {
+	rows, err := r.db.Query("SELECT order_id, from_status, to_status, changed_by, reason, created_at FROM order_status_history WHERE order_id = $1 ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []OrderStatusChange
+	for rows.Next() {
+		var change OrderStatusChange
+		err := rows.Scan(&change.OrderID, &change.FromStatus, &change.ToStatus, &change.ChangedBy, &change.Reason, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
 // ProductRepositoryImpl implements ProductRepository
 type ProductRepositoryImpl struct {
 	db *sql.DB
@@ -43,7 +262,7 @@ func NewProductRepository(db *sql.DB) ProductRepository {
 }
 
 func (r *ProductRepositoryImpl) GetAll() ([]Product, error) {
-	rows, err := r.db.Query("SELECT id, name, price, stock_quantity FROM products")
+	rows, err := r.db.Query("SELECT id, name, price, stock_quantity, reserved_quantity FROM products WHERE deleted_at IS NULL ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +271,7 @@ func (r *ProductRepositoryImpl) GetAll() ([]Product, error) {
 	var products []Product
 	for rows.Next() {
 		var p Product
-		err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.StockQuantity)
+		err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.StockQuantity, &p.ReservedQuantity)
 		if err != nil {
 			return nil, err
 		}
@@ -61,18 +280,156 @@ func (r *ProductRepositoryImpl) GetAll() ([]Product, error) {
 	return products, nil
 }
 
-func (r *ProductRepositoryImpl) GetByID(tx *sql.Tx, id int) (*Product, error) {
+func (r *ProductRepositoryImpl) Get(id int) (*Product, error) {
 	var product Product
-	err := tx.QueryRow("SELECT id, name, price, stock_quantity FROM products WHERE id = $1", id).
-		Scan(&product.ID, &product.Name, &product.Price, &product.StockQuantity)
+	err := r.db.QueryRow("SELECT id, name, price, stock_quantity, reserved_quantity FROM products WHERE id = $1 AND deleted_at IS NULL", id).
+		Scan(&product.ID, &product.Name, &product.Price, &product.StockQuantity, &product.ReservedQuantity)
 	return &product, err
 }
 
-func (r *ProductRepositoryImpl) UpdateStock(tx *sql.Tx, id, quantity int) error {
-	_, err := tx.Exec("UPDATE products SET stock_quantity = stock_quantity - $1 WHERE id = $2", quantity, id)
+// LockByIDs selects the products FOR UPDATE in id order, so two orders locking overlapping products
+// always acquire the locks in the same order and cannot deadlock
+func (r *ProductRepositoryImpl) LockByIDs(tx *sql.Tx, ids []int) (map[int]*Product, error) {
+	productIDs := make([]int64, len(ids))
+	for i, id := range ids {
+		productIDs[i] = int64(id)
+	}
+
+	rows, err := tx.Query("SELECT id, name, price, stock_quantity, reserved_quantity FROM products WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id FOR UPDATE",
+		pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make(map[int]*Product, len(ids))
+	for rows.Next() {
+		var p Product
+		err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.StockQuantity, &p.ReservedQuantity)
+		if err != nil {
+			return nil, err
+		}
+		products[p.ID] = &p
+	}
+	return products, rows.Err()
+}
+
+// Create inserts the product and reloads it with the values the database stored
+func (r *ProductRepositoryImpl) Create(tx *sql.Tx, product *Product) error {
+	return tx.QueryRow("INSERT INTO products (name, price, stock_quantity) VALUES ($1, $2, $3) RETURNING id, name, price, stock_quantity, reserved_quantity",
+		product.Name, product.Price, product.StockQuantity).
+		Scan(&product.ID, &product.Name, &product.Price, &product.StockQuantity, &product.ReservedQuantity)
+}
+
+// Update stores the product and reloads it with the values the database stored. It refuses to take
+// stock_quantity below what open orders have reserved, failing with ErrInvalidProduct.
+func (r *ProductRepositoryImpl) Update(tx *sql.Tx, product *Product) error {
+	err := tx.QueryRow("UPDATE products SET name = $1, price = $2, stock_quantity = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $4 AND deleted_at IS NULL AND $3 >= reserved_quantity RETURNING id, name, price, stock_quantity, reserved_quantity",
+		product.Name, product.Price, product.StockQuantity, product.ID).
+		Scan(&product.ID, &product.Name, &product.Price, &product.StockQuantity, &product.ReservedQuantity)
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	var reserved int
+	if err := tx.QueryRow("SELECT reserved_quantity FROM products WHERE id = $1 AND deleted_at IS NULL", product.ID).Scan(&reserved); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: stock_quantity must not be below the %d units reserved by open orders", ErrInvalidProduct, reserved)
+}
+
+func (r *ProductRepositoryImpl) SoftDelete(tx *sql.Tx, id int) error {
+	result, err := tx.Exec("UPDATE products SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL", id)
+	return requireAffected(result, err)
+}
+
+// Reserve holds quantity out of the unreserved stock, returning ErrInsufficientStock when too little is left
+func (r *ProductRepositoryImpl) Reserve(tx *sql.Tx, id, quantity int) error {
+	result, err := tx.Exec("UPDATE products SET reserved_quantity = reserved_quantity + $1 WHERE id = $2 AND stock_quantity - reserved_quantity >= $1", quantity, id)
+	err = requireAffected(result, err)
+	if err == sql.ErrNoRows {
+		return ErrInsufficientStock
+	}
+	return err
+}
+
+func (r *ProductRepositoryImpl) ReleaseReserved(tx *sql.Tx, id, quantity int) error {
+	_, err := tx.Exec("UPDATE products SET reserved_quantity = reserved_quantity - $1 WHERE id = $2", quantity, id)
+	return err
+}
+
+// CommitReserved turns a hold into a permanent deduction
+func (r *ProductRepositoryImpl) CommitReserved(tx *sql.Tx, id, quantity int) error {
+	_, err := tx.Exec("UPDATE products SET stock_quantity = stock_quantity - $1, reserved_quantity = reserved_quantity - $1 WHERE id = $2", quantity, id)
+	return err
+}
+
+func (r *ProductRepositoryImpl) RestoreStock(tx *sql.Tx, id, quantity int) error {
+	_, err := tx.Exec("UPDATE products SET stock_quantity = stock_quantity + $1 WHERE id = $2", quantity, id)
 	return err
 }
 
+// ReservationRepositoryImpl implements ReservationRepository
+type ReservationRepositoryImpl struct {
+	db *sql.DB
+}
+
+func NewReservationRepository(db *sql.DB) ReservationRepository {
+	return &ReservationRepositoryImpl{db: db}
+}
+
+// Create stores a hold that expires ttl after the database clock's current time, so the expiry and every check of it
+// use the same clock
+func (r *ReservationRepositoryImpl) Create(tx *sql.Tx, reservation *Reservation, ttl time.Duration) error {
+	return tx.QueryRow(`INSERT INTO reservations (order_id, product_id, quantity, status, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5)) RETURNING id, expires_at`,
+		reservation.OrderID, reservation.ProductID, reservation.Quantity, reservation.Status, ttl.Seconds()).
+		Scan(&reservation.ID, &reservation.ExpiresAt)
+}
+
+func (r *ReservationRepositoryImpl) GetByOrderForUpdate(tx *sql.Tx, orderID int) ([]Reservation, error) {
+	rows, err := tx.Query(`SELECT id, order_id, product_id, quantity, status, expires_at, expires_at < CURRENT_TIMESTAMP
+		FROM reservations WHERE order_id = $1 ORDER BY product_id FOR UPDATE`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []Reservation
+	for rows.Next() {
+		var reservation Reservation
+		err := rows.Scan(&reservation.ID, &reservation.OrderID, &reservation.ProductID, &reservation.Quantity, &reservation.Status, &reservation.ExpiresAt, &reservation.Expired)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+	return reservations, rows.Err()
+}
+
+func (r *ReservationRepositoryImpl) UpdateStatus(tx *sql.Tx, id int, status ReservationStatus) error {
+	_, err := tx.Exec("UPDATE reservations SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", status, id)
+	return err
+}
+
+func (r *ReservationRepositoryImpl) ListExpiredOrderIDs(limit int) ([]int, error) {
+	rows, err := r.db.Query("SELECT DISTINCT order_id FROM reservations WHERE status = 'held' AND expires_at < CURRENT_TIMESTAMP ORDER BY order_id LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orderIDs []int
+	for rows.Next() {
+		var orderID int
+		if err := rows.Scan(&orderID); err != nil {
+			return nil, err
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	return orderIDs, rows.Err()
+}
+
 // OutboxRepositoryImpl implements OutboxRepository
 type OutboxRepositoryImpl struct {
 	db *sql.DB
@@ -83,14 +440,31 @@ func NewOutboxRepository(db *sql.DB) OutboxRepository {
 }
 
 func (r *OutboxRepositoryImpl) Store(tx *sql.Tx, event *SagaEvent) error {
-	eventData, _ := json.Marshal(event.Data)
-	_, err := tx.Exec("INSERT INTO outbox_events (event_id, event_type, aggregate_id, event_data) VALUES ($1, $2, $3, $4)",
-		event.ID, event.Type, event.OrderID, eventData)
+	dataVersion, eventData, err := events.Default.Encode(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox_events (event_id, event_type, aggregate_id, event_data, data_version) VALUES ($1, $2, $3, $4, $5)",
+		event.ID, event.Type, event.OrderID, eventData, dataVersion)
 	return err
 }
 
-func (r *OutboxRepositoryImpl) GetUnprocessed() ([]OutboxEvent, error) {
-	rows, err := r.db.Query("SELECT id, event_id, event_type, aggregate_id, event_data FROM outbox_events WHERE processed = false ORDER BY created_at")
+// Claim leases up to limit unprocessed events to owner. Rows locked by another relay are skipped, and a
+// lease that runs out (for example because its relay crashed) makes the event claimable again.
+func (r *OutboxRepositoryImpl) Claim(owner string, lease time.Duration, limit int) ([]OutboxEvent, error) {
+	rows, err := r.db.Query(`UPDATE outbox_events
+		SET locked_by = $1, locked_until = CURRENT_TIMESTAMP + make_interval(secs => $2), attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox_events
+			WHERE processed = false
+				AND (locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)
+				AND (next_attempt_at IS NULL OR next_attempt_at <= CURRENT_TIMESTAMP)
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, event_id, event_type, aggregate_id, event_data, data_version, attempts`,
+		owner, lease.Seconds(), limit)
 	if err != nil {
 		return nil, err
 	}
@@ -99,16 +473,236 @@ func (r *OutboxRepositoryImpl) GetUnprocessed() ([]OutboxEvent, error) {
 	var events []OutboxEvent
 	for rows.Next() {
 		var event OutboxEvent
-		err := rows.Scan(&event.ID, &event.EventID, &event.EventType, &event.AggregateID, &event.EventData)
+		err := rows.Scan(&event.ID, &event.EventID, &event.EventType, &event.AggregateID, &event.EventData, &event.DataVersion, &event.Attempts)
 		if err != nil {
 			return nil, err
 		}
 		events = append(events, event)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not keep the subquery's order
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
 	return events, nil
 }
 
-func (r *OutboxRepositoryImpl) MarkProcessed(id int) error {
-	_, err := r.db.Exec("UPDATE outbox_events SET processed = true WHERE id = $1", id)
+// MarkProcessed only succeeds while owner still holds the lease, returning sql.ErrNoRows otherwise
+func (r *OutboxRepositoryImpl) MarkProcessed(id int, owner string) error {
+	result, err := r.db.Exec(`UPDATE outbox_events
+		SET processed = true, processed_at = CURRENT_TIMESTAMP, last_error = NULL, locked_by = NULL, locked_until = NULL
+		WHERE id = $1 AND locked_by = $2`, id, owner)
+	return requireAffected(result, err)
+}
+
+// MarkFailed records the publish error and releases the lease; the event is not claimed again before nextAttemptAt
+func (r *OutboxRepositoryImpl) MarkFailed(id int, owner string, lastError string, nextAttemptAt time.Time) error {
+	result, err := r.db.Exec(`UPDATE outbox_events
+		SET last_error = $3, next_attempt_at = $4, locked_by = NULL, locked_until = NULL
+		WHERE id = $1 AND locked_by = $2`, id, owner, lastError, nextAttemptAt)
+	return requireAffected(result, err)
+}
+
+// DeadLetter moves an event that owner still holds from the outbox to outbox_dead_letters
+func (r *OutboxRepositoryImpl) DeadLetter(id int, owner string, lastError string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO outbox_dead_letters (event_id, event_type, aggregate_id, event_data, data_version, attempts, last_error, created_at)
+		SELECT event_id, event_type, aggregate_id, event_data, data_version, attempts, $3, created_at
+		FROM outbox_events WHERE id = $1 AND locked_by = $2`, id, owner, lastError)
+	if err = requireAffected(result, err); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM outbox_events WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *OutboxRepositoryImpl) ListDeadLetters(limit int) ([]DeadLetter, error) {
+	rows, err := r.db.Query(`SELECT id, event_id, event_type, aggregate_id, event_data, data_version, attempts, last_error, created_at, dead_lettered_at,
+		redriven_at FROM outbox_dead_letters WHERE redriven_at IS NULL ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []DeadLetter{}
+	for rows.Next() {
+		deadLetter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, *deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
+
+func (r *OutboxRepositoryImpl) GetDeadLetter(id int) (*DeadLetter, error) {
+	row := r.db.QueryRow(`SELECT id, event_id, event_type, aggregate_id, event_data, data_version, attempts, last_error, created_at, dead_lettered_at,
+		redriven_at FROM outbox_dead_letters WHERE id = $1`, id)
+	return scanDeadLetter(row)
+}
+
+// Redrive puts a dead-lettered event back in the outbox with a fresh attempt count
+func (r *OutboxRepositoryImpl) Redrive(id int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO outbox_events (event_id, event_type, aggregate_id, event_data, data_version, created_at)
+		SELECT event_id, event_type, aggregate_id, event_data, data_version, created_at
+		FROM outbox_dead_letters WHERE id = $1 AND redriven_at IS NULL`, id)
+	if err = requireAffected(result, err); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE outbox_dead_letters SET redriven_at = CURRENT_TIMESTAMP WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDeadLetter(row rowScanner) (*DeadLetter, error) {
+	var deadLetter DeadLetter
+	var redrivenAt sql.NullTime
+	err := row.Scan(&deadLetter.ID, &deadLetter.EventID, &deadLetter.EventType, &deadLetter.AggregateID, &deadLetter.EventData,
+		&deadLetter.DataVersion, &deadLetter.Attempts, &deadLetter.LastError, &deadLetter.CreatedAt, &deadLetter.DeadLetteredAt, &redrivenAt)
+	if err != nil {
+		return nil, err
+	}
+	if redrivenAt.Valid {
+		deadLetter.RedrivenAt = &redrivenAt.Time
+	}
+	return &deadLetter, nil
+}
+
+// IdempotencyRepositoryImpl implements IdempotencyRepository
+type IdempotencyRepositoryImpl struct {
+	db *sql.DB
+}
+
+func NewIdempotencyRepository(db *sql.DB) IdempotencyRepository {
+	return &IdempotencyRepositoryImpl{db: db}
+}
+
+func (r *IdempotencyRepositoryImpl) Get(key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	err := r.db.QueryRow("SELECT key, request_hash, status_code, response FROM idempotency_keys WHERE key = $1", key).
+		Scan(&record.Key, &record.RequestHash, &record.StatusCode, &record.Response)
+	return &record, err
+}
+
+// Store returns ErrDuplicateIdempotencyKey when another request already stored the key
+func (r *IdempotencyRepositoryImpl) Store(tx *sql.Tx, record *IdempotencyRecord) error {
+	_, err := tx.Exec("INSERT INTO idempotency_keys (key, request_hash, status_code, response) VALUES ($1, $2, $3, $4)",
+		record.Key, record.RequestHash, record.StatusCode, record.Response)
+	if isUniqueViolation(err) {
+		return ErrDuplicateIdempotencyKey
+	}
+	return err
+}
+
+// InboxRepositoryImpl implements InboxRepository
+type InboxRepositoryImpl struct {
+	db *sql.DB
+}
+
+func NewInboxRepository(db *sql.DB) InboxRepository {
+	return &InboxRepositoryImpl{db: db}
+}
+
+// Record returns ErrDuplicateEvent when the event was already recorded. A concurrent delivery of the
+// same event waits on the primary key until the first transaction finishes.
+func (r *InboxRepositoryImpl) Record(tx *sql.Tx, event *SagaEvent) error {
+	result, err := tx.Exec(`INSERT INTO inbox_events (event_id, event_type, order_id) VALUES ($1, $2, $3)
+		ON CONFLICT (event_id) DO NOTHING`, event.ID, event.Type, event.OrderID)
+	if err := requireAffected(result, err); err == sql.ErrNoRows {
+		return ErrDuplicateEvent
+	}
 	return err
-}
\ No newline at end of file
+}
+
+func (r *InboxRepositoryImpl) RecordDuplicate(eventID string) error {
+	_, err := r.db.Exec(`UPDATE inbox_events SET duplicate_count = duplicate_count + 1, last_duplicate_at = CURRENT_TIMESTAMP
+		WHERE event_id = $1`, eventID)
+	return err
+}
+
+func (r *InboxRepositoryImpl) Stats() (*InboxStats, error) {
+	var stats InboxStats
+	err := r.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(duplicate_count), 0) FROM inbox_events").
+		Scan(&stats.Processed, &stats.Duplicates)
+	return &stats, err
+}
+
+// QuarantineRepositoryImpl implements QuarantineRepository
+type QuarantineRepositoryImpl struct {
+	db *sql.DB
+}
+
+func NewQuarantineRepository(db *sql.DB) QuarantineRepository {
+	return &QuarantineRepositoryImpl{db: db}
+}
+
+func (r *QuarantineRepositoryImpl) Store(message *QuarantinedMessage) error {
+	return r.db.QueryRow(`INSERT INTO quarantined_messages (message_id, topic, payload, reason)
+		VALUES ($1, $2, $3, $4) RETURNING id, quarantined_at`,
+		message.MessageID, message.Topic, message.Payload, message.Reason).Scan(&message.ID, &message.QuarantinedAt)
+}
+
+func (r *QuarantineRepositoryImpl) List(limit int) ([]QuarantinedMessage, error) {
+	rows, err := r.db.Query(`SELECT id, message_id, topic, payload, reason, quarantined_at FROM quarantined_messages
+		ORDER BY id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []QuarantinedMessage{}
+	for rows.Next() {
+		var message QuarantinedMessage
+		err := rows.Scan(&message.ID, &message.MessageID, &message.Topic, &message.Payload, &message.Reason, &message.QuarantinedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// requireAffected turns an update that matched no rows into sql.ErrNoRows
+func requireAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
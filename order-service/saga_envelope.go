@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"order-service/events"
+)
+
+// sagaEventVersion is the envelope version this service writes and the only one it accepts
+const sagaEventVersion = 1
+
+var (
+	ErrMalformedEvent   = errors.New("malformed saga event")
+	ErrUnknownEventType = errors.New("unknown saga event type")
+)
+
+// newSagaEvent wraps payload in a new envelope for the order or product with the given id
+func newSagaEvent(aggregateID int, payload events.Payload) *SagaEvent {
+	return &SagaEvent{
+		ID:        uuid.New().String(),
+		Type:      payload.EventType(),
+		OrderID:   aggregateID,
+		Data:      payload,
+		Timestamp: time.Now(),
+	}
+}
+
+func encodeSagaEvent(event SagaEvent) ([]byte, error) {
+	dataVersion, err := events.Default.Version(event.Type)
+	if err != nil {
+		return nil, err
+	}
+	event.Version = sagaEventVersion
+	event.DataVersion = dataVersion
+	return json.Marshal(event)
+}
+
+// sagaEventWire is the envelope as sent, with the payload left raw until its type and version are known
+type sagaEventWire struct {
+	SagaEvent
+	Data json.RawMessage `json:"data"`
+}
+
+// decodeSagaEvent rejects payloads that are not exactly one supported envelope: unknown fields,
+// trailing data, another version, or a missing id, type or order. The data is decoded into the
+// registered payload type, upcast to its current schema.
+func decodeSagaEvent(payload []byte) (SagaEvent, error) {
+	var wire sagaEventWire
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&wire); err != nil {
+		return wire.SagaEvent, fmt.Errorf("%w: %v", ErrMalformedEvent, err)
+	}
+	if decoder.More() {
+		return wire.SagaEvent, fmt.Errorf("%w: unexpected data after the event", ErrMalformedEvent)
+	}
+
+	event := wire.SagaEvent
+	switch {
+	case event.Version != sagaEventVersion:
+		return event, fmt.Errorf("%w: unsupported version %d", ErrMalformedEvent, event.Version)
+	case event.ID == "":
+		return event, fmt.Errorf("%w: missing id", ErrMalformedEvent)
+	case event.Type == "":
+		return event, fmt.Errorf("%w: missing type", ErrMalformedEvent)
+	case event.OrderID <= 0:
+		return event, fmt.Errorf("%w: missing order_id", ErrMalformedEvent)
+	}
+
+	data, err := events.Default.Decode(event.Type, event.DataVersion, wire.Data)
+	if errors.Is(err, events.ErrUnknownType) {
+		return event, fmt.Errorf("%w: %v", ErrUnknownEventType, err)
+	}
+	if err != nil {
+		return event, fmt.Errorf("%w: %v", ErrMalformedEvent, err)
+	}
+	event.Data = data
+	event.DataVersion, _ = events.Default.Version(event.Type)
+	return event, nil
+}
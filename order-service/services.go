@@ -4,93 +4,162 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+
+	"order-service/events"
 )
 
 // OrderServiceImpl implements OrderService
 type OrderServiceImpl struct {
-	orderRepo   OrderRepository
-	productRepo ProductRepository
-	outboxRepo  OutboxRepository
-	db          *sql.DB
+	orderRepo       OrderRepository
+	productRepo     ProductRepository
+	outboxRepo      OutboxRepository
+	reservationRepo ReservationRepository
+	idempotencyRepo IdempotencyRepository
+	inboxRepo       InboxRepository
+	reservationTTL  time.Duration
+	sagaTimeout     time.Duration
+	db              *sql.DB
 }
 
-func NewOrderService(orderRepo OrderRepository, productRepo ProductRepository, outboxRepo OutboxRepository, db *sql.DB) OrderService {
+func NewOrderService(orderRepo OrderRepository, productRepo ProductRepository, outboxRepo OutboxRepository, reservationRepo ReservationRepository,
+	idempotencyRepo IdempotencyRepository, inboxRepo InboxRepository, reservationTTL, sagaTimeout time.Duration, db *sql.DB) OrderService {
 	return &OrderServiceImpl{
-		orderRepo:   orderRepo,
-		productRepo: productRepo,
-		outboxRepo:  outboxRepo,
-		db:          db,
+		orderRepo:       orderRepo,
+		productRepo:     productRepo,
+		outboxRepo:      outboxRepo,
+		reservationRepo: reservationRepo,
+		idempotencyRepo: idempotencyRepo,
+		inboxRepo:       inboxRepo,
+		reservationTTL:  reservationTTL,
+		sagaTimeout:     sagaTimeout,
+		db:              db,
 	}
 }
 
-func (s *OrderServiceImpl) CreateOrder(order *Order) (*Order, error) {
+// CreateOrder stores the order; when idempotency is set, its response is saved in the same transaction
+// so a retried request either replays this order or fails with ErrDuplicateIdempotencyKey.
+func (s *OrderServiceImpl) CreateOrder(order *Order, idempotency *IdempotencyRecord) (*Order, error) {
+	if len(order.Items) == 0 {
+		return nil, fmt.Errorf("%w: order has no items", ErrInvalidOrder)
+	}
+
+	// Quantities are summed per product so an order listing a product twice is checked against its total
+	quantities := make(map[int]int)
+	var productIDs []int
+	for _, item := range order.Items {
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("%w: quantity for product %d must be positive", ErrInvalidOrder, item.ProductID)
+		}
+		if _, seen := quantities[item.ProductID]; !seen {
+			productIDs = append(productIDs, item.ProductID)
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+
 	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
-	// Calculate total and check stock
+	// Lock every product row before checking stock so concurrent orders cannot both pass the check
+	products, err := s.productRepo.LockByIDs(tx, productIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Calculate total and hold stock until the order is confirmed, cancelled or the hold expires
 	var totalAmount float64
-	for _, item := range order.Items {
-		product, err := s.productRepo.GetByID(tx, item.ProductID)
-		if err != nil {
-			return nil, err
+	for _, productID := range productIDs {
+		product, exists := products[productID]
+		if !exists {
+			return nil, fmt.Errorf("%w: %d", ErrProductNotFound, productID)
 		}
 
-		if product.StockQuantity < item.Quantity {
-			return nil, fmt.Errorf("insufficient stock for product %d", item.ProductID)
+		if product.StockQuantity-product.ReservedQuantity < quantities[productID] {
+			return nil, fmt.Errorf("%w for product %d", ErrInsufficientStock, productID)
 		}
 
-		totalAmount += product.Price * float64(item.Quantity)
-		
-		err = s.productRepo.UpdateStock(tx, item.ProductID, item.Quantity)
+		totalAmount += product.Price * float64(quantities[productID])
+
+		err = s.productRepo.Reserve(tx, productID, quantities[productID])
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	order.TotalAmount = totalAmount
-	orderID, err := s.orderRepo.Create(tx, order)
+	order.SagaStep = SagaStepAwaitingPayment
+	orderID, err := s.orderRepo.Create(tx, order, s.sagaTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create order items
-	for _, item := range order.Items {
-		product, _ := s.productRepo.GetByID(tx, item.ProductID)
+	for _, productID := range productIDs {
+		err = s.reservationRepo.Create(tx, &Reservation{
+			OrderID:   orderID,
+			ProductID: productID,
+			Quantity:  quantities[productID],
+			Status:    ReservationHeld,
+		}, s.reservationTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create order items with the price captured at order time
+	for i, item := range order.Items {
+		order.Items[i].Price = products[item.ProductID].Price
 		_, err = tx.Exec("INSERT INTO order_items (order_id, product_id, quantity, price) VALUES ($1, $2, $3, $4)",
-			orderID, item.ProductID, item.Quantity, product.Price)
+			orderID, item.ProductID, item.Quantity, order.Items[i].Price)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	// Store saga event in outbox
-	sagaEvent := &SagaEvent{
-		ID:        uuid.New().String(),
-		Type:      "ORDER_CREATED",
-		OrderID:   orderID,
-		Data:      map[string]interface{}{"customer_id": order.CustomerID, "total_amount": totalAmount},
-		Timestamp: time.Now(),
+	lines := make([]events.OrderLine, len(order.Items))
+	for i, item := range order.Items {
+		lines[i] = events.OrderLine{ProductID: item.ProductID, Quantity: item.Quantity, Price: item.Price}
 	}
-
-	err = s.outboxRepo.Store(tx, sagaEvent)
+	err = s.outboxRepo.Store(tx, newSagaEvent(orderID, &events.OrderCreated{
+		CustomerID:  order.CustomerID,
+		TotalAmount: totalAmount,
+		Items:       lines,
+	}))
 	if err != nil {
 		return nil, err
 	}
 
+	order.ID = orderID
+	order.Status = OrderStatusPending
+
+	if idempotency != nil {
+		idempotency.StatusCode = 201
+		idempotency.Response, err = json.Marshal(order)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.idempotencyRepo.Store(tx, idempotency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 
-	order.ID = orderID
-	order.Status = "pending"
 	return order, nil
 }
 
@@ -98,86 +167,682 @@ func (s *OrderServiceImpl) GetOrder(id int) (*Order, error) {
 	return s.orderRepo.GetByID(id)
 }
 
-func (s *OrderServiceImpl) UpdateOrderStatus(id int, status string) error {
-	return s.orderRepo.UpdateStatus(id, status)
+// ListOrders returns one page of orders and the cursor for the next page, if there is one
+func (s *OrderServiceImpl) ListOrders(filter OrderFilter) (*OrderPage, error) {
+	if filter.SortBy == "" {
+		filter.SortBy = "created_at"
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultOrderPageSize
+	}
+	if filter.Limit > maxOrderPageSize {
+		filter.Limit = maxOrderPageSize
+	}
+	// A cursor from a page sorted another way would skip or repeat orders
+	if filter.Cursor != nil && (filter.Cursor.SortBy != filter.SortBy || filter.Cursor.Descending != filter.Descending) {
+		return nil, ErrInvalidCursor
+	}
+
+	// One extra row tells us whether another page follows
+	pageSize := filter.Limit
+	filter.Limit++
+	orders, err := s.orderRepo.List(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &OrderPage{Orders: orders}
+	if len(orders) > pageSize {
+		page.Orders = orders[:pageSize]
+		page.NextCursor = newOrderCursor(filter, page.Orders[pageSize-1]).Encode()
+	}
+	return page, nil
+}
+
+// UpdateOrderStatus moves the order to status if the transition table allows it and records who did it.
+// Requesting the status the order already has is a no-op, so retried calls are safe.
+func (s *OrderServiceImpl) UpdateOrderStatus(id int, status OrderStatus, changedBy, reason string) error {
+	if !status.Valid() {
+		return fmt.Errorf("%w: %q", ErrUnknownOrderStatus, status)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = s.transition(tx, id, status, changedBy, reason)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *OrderServiceImpl) CancelOrder(id int, changedBy, reason string) error {
+	return s.UpdateOrderStatus(id, OrderStatusCancelled, changedBy, reason)
+}
+
+// ApplyEvent runs the choreography saga's reaction to a sales-service event. The event is recorded in
+// the inbox in the same transaction, so a redelivered event returns ErrDuplicateEvent instead of being
+// applied twice. A payment whose stock hold already expired cancels the order instead of confirming it.
+func (s *OrderServiceImpl) ApplyEvent(event SagaEvent) error {
+	reaction, exists := sagaReactions[event.Type]
+	if !exists {
+		return fmt.Errorf("%w: %q", ErrUnknownEventType, event.Type)
+	}
+
+	err := s.applyReaction(event, reaction)
+	if errors.Is(err, ErrReservationExpired) {
+		return s.applyReaction(event, cancelReaction("stock reservation expired before payment"))
+	}
+	return err
+}
+
+func (s *OrderServiceImpl) applyReaction(event SagaEvent, reaction sagaReaction) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.inboxRepo.Record(tx, &event)
+	if err != nil {
+		return err
+	}
+
+	status, step, err := s.orderRepo.GetSagaStateForUpdate(tx, event.OrderID)
+	if err != nil {
+		return err
+	}
+
+	if step != SagaStepAwaitingPayment || status != OrderStatusPending {
+		// The order left the payment step without this event. A payment for an order that was
+		// cancelled meanwhile is answered with ORDER_CANCELLED so that sales-service voids it.
+		if status == OrderStatusCancelled && event.Type == events.TypeSalesTransactionCompleted {
+			err = s.outboxRepo.Store(tx, newSagaEvent(event.OrderID, &events.OrderCancelled{Reason: "payment received after the order was cancelled"}))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	_, err = s.transition(tx, event.OrderID, reaction.status, "saga", event.Type)
+	if err != nil {
+		return err
+	}
+
+	err = s.orderRepo.UpdateSagaStep(tx, event.OrderID, reaction.step)
+	if err != nil {
+		return err
+	}
+
+	err = s.outboxRepo.Store(tx, newSagaEvent(event.OrderID, reaction.followUp(event)))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TimeoutSaga cancels an order that is still waiting for sales-service after its deadline, releasing its
+// stock, and publishes ORDER_CANCELLED so a payment that is still in flight gets voided
+func (s *OrderServiceImpl) TimeoutSaga(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, step, err := s.orderRepo.GetSagaStateForUpdate(tx, id)
+	if err != nil {
+		return err
+	}
+	if step != SagaStepAwaitingPayment || status != OrderStatusPending {
+		return nil
+	}
+
+	_, err = s.transition(tx, id, OrderStatusCancelled, "saga-timeout", "no sales response before the saga deadline")
+	if err != nil {
+		return err
+	}
+
+	err = s.orderRepo.UpdateSagaStep(tx, id, SagaStepTimedOut)
+	if err != nil {
+		return err
+	}
+
+	err = s.outboxRepo.Store(tx, newSagaEvent(id, &events.OrderCancelled{Reason: "no sales response before the saga deadline"}))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ExpireReservations cancels a pending order whose stock hold ran out and emits RESERVATION_EXPIRED
+func (s *OrderServiceImpl) ExpireReservations(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changed, err := s.transition(tx, id, OrderStatusCancelled, "reservation-sweeper", "stock reservation expired")
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	err = s.outboxRepo.Store(tx, newSagaEvent(id, &events.ReservationExpired{Reason: "stock reservation expired"}))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// transition applies a status change and its inventory side effects inside tx. Cancelling a confirmed order,
+// which has been paid for, also publishes ORDER_CANCELLED so that sales-service voids the charge.
+// It reports false without error when the order already has the requested status.
+func (s *OrderServiceImpl) transition(tx *sql.Tx, id int, status OrderStatus, changedBy, reason string) (bool, error) {
+	current, err := s.orderRepo.GetStatusForUpdate(tx, id)
+	if err != nil {
+		return false, err
+	}
+	if current == status {
+		return false, nil
+	}
+	if !current.CanTransitionTo(status) {
+		return false, &InvalidTransitionError{Current: current, Requested: status}
+	}
+
+	err = s.orderRepo.UpdateStatus(tx, id, status)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case status == OrderStatusCancelled:
+		err = s.releaseReservations(tx, id)
+		if err == nil && current == OrderStatusConfirmed {
+			err = s.outboxRepo.Store(tx, newSagaEvent(id, &events.OrderCancelled{Reason: cancelledAfterPaymentReason(changedBy, reason)}))
+		}
+	case current == OrderStatusPending && (status == OrderStatusConfirmed || status == OrderStatusCompleted):
+		err = s.commitReservations(tx, id)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = s.orderRepo.RecordStatusChange(tx, &OrderStatusChange{
+		OrderID:    id,
+		FromStatus: current,
+		ToStatus:   status,
+		ChangedBy:  changedBy,
+		Reason:     reason,
+	})
+	return err == nil, err
+}
+
+func cancelledAfterPaymentReason(changedBy, reason string) string {
+	if reason == "" {
+		return "confirmed order cancelled by " + changedBy
+	}
+	return reason
+}
+
+// commitReservations turns the order's holds into stock deductions; an expired hold can no longer be confirmed
+func (s *OrderServiceImpl) commitReservations(tx *sql.Tx, orderID int) error {
+	reservations, err := s.reservationRepo.GetByOrderForUpdate(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	for _, reservation := range reservations {
+		if reservation.Status != ReservationHeld {
+			continue
+		}
+		if reservation.Expired {
+			return fmt.Errorf("%w for order %d", ErrReservationExpired, orderID)
+		}
+
+		err = s.productRepo.CommitReserved(tx, reservation.ProductID, reservation.Quantity)
+		if err != nil {
+			return err
+		}
+		err = s.reservationRepo.UpdateStatus(tx, reservation.ID, ReservationCommitted)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseReservations gives back held stock, and restores stock that was already committed
+func (s *OrderServiceImpl) releaseReservations(tx *sql.Tx, orderID int) error {
+	reservations, err := s.reservationRepo.GetByOrderForUpdate(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	for _, reservation := range reservations {
+		switch reservation.Status {
+		case ReservationHeld:
+			err = s.productRepo.ReleaseReserved(tx, reservation.ProductID, reservation.Quantity)
+		case ReservationCommitted:
+			err = s.productRepo.RestoreStock(tx, reservation.ProductID, reservation.Quantity)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.reservationRepo.UpdateStatus(tx, reservation.ID, ReservationReleased)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *OrderServiceImpl) GetStatusHistory(id int) ([]OrderStatusChange, error) {
+	return s.orderRepo.GetStatusHistory(id)
+}
+
+// ReservationServiceImpl implements ReservationService
+type ReservationServiceImpl struct {
+	reservationRepo ReservationRepository
+	orderService    OrderService
+	interval        time.Duration
+}
+
+func NewReservationService(reservationRepo ReservationRepository, orderService OrderService, interval time.Duration) ReservationService {
+	return &ReservationServiceImpl{
+		reservationRepo: reservationRepo,
+		orderService:    orderService,
+		interval:        interval,
+	}
+}
+
+// ReleaseExpired periodically cancels orders whose stock holds expired before they were confirmed
+func (s *ReservationServiceImpl) ReleaseExpired() {
+	for {
+		orderIDs, err := s.reservationRepo.ListExpiredOrderIDs(100)
+		if err != nil {
+			log.Printf("Failed to list expired reservations: %v", err)
+		}
+
+		for _, orderID := range orderIDs {
+			if err := s.orderService.ExpireReservations(orderID); err != nil {
+				log.Printf("Failed to release expired reservations for order %d: %v", orderID, err)
+			}
+		}
+
+		time.Sleep(s.interval)
+	}
+}
+
+// ProductServiceImpl implements ProductService
+type ProductServiceImpl struct {
+	productRepo ProductRepository
+	outboxRepo  OutboxRepository
+	db          *sql.DB
+}
+
+func NewProductService(productRepo ProductRepository, outboxRepo OutboxRepository, db *sql.DB) ProductService {
+	return &ProductServiceImpl{
+		productRepo: productRepo,
+		outboxRepo:  outboxRepo,
+		db:          db,
+	}
+}
+
+func (s *ProductServiceImpl) GetProduct(id int) (*Product, error) {
+	return s.productRepo.Get(id)
+}
+
+func (s *ProductServiceImpl) CreateProduct(product *Product) (*Product, error) {
+	if err := validateProduct(product); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The event carries the stored row, not ReservedQuantity or anything else the client sent
+	err = s.productRepo.Create(tx, product)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.storeProductEvent(tx, events.TypeProductCreated, product)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+func (s *ProductServiceImpl) UpdateProduct(product *Product) (*Product, error) {
+	if err := validateProduct(product); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = s.productRepo.Update(tx, product)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.storeProductEvent(tx, events.TypeProductUpdated, product)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// DeleteProduct hides the product from the catalog and new orders; existing order items keep referencing it
+func (s *ProductServiceImpl) DeleteProduct(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.productRepo.SoftDelete(tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storeProductEvent(tx, events.TypeProductDeleted, &Product{ID: id})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// storeProductEvent writes a catalog change to the outbox so other services can follow the catalog
+func (s *ProductServiceImpl) storeProductEvent(tx *sql.Tx, eventType string, product *Product) error {
+	return s.outboxRepo.Store(tx, newSagaEvent(product.ID, &events.ProductChanged{
+		Type:             eventType,
+		ID:               product.ID,
+		Name:             product.Name,
+		Price:            product.Price,
+		StockQuantity:    product.StockQuantity,
+		ReservedQuantity: product.ReservedQuantity,
+	}))
+}
+
+func validateProduct(product *Product) error {
+	switch {
+	case product.Name == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidProduct)
+	case product.Price < 0:
+		return fmt.Errorf("%w: price must not be negative", ErrInvalidProduct)
+	case product.StockQuantity < 0:
+		return fmt.Errorf("%w: stock_quantity must not be negative", ErrInvalidProduct)
+	}
+	return nil
 }
 
 // SagaServiceImpl implements SagaService
 type SagaServiceImpl struct {
-	rdb         *redis.Client
-	orderRepo   OrderRepository
-	productRepo ProductRepository
+	bus            MessageBus
+	orderService   OrderService
+	orderRepo      OrderRepository
+	productRepo    ProductRepository
+	inboxRepo      InboxRepository
+	quarantineRepo QuarantineRepository
+	sweepInterval  time.Duration
 }
 
-func NewSagaService(rdb *redis.Client, orderRepo OrderRepository, productRepo ProductRepository) SagaService {
+func NewSagaService(bus MessageBus, orderService OrderService, orderRepo OrderRepository, productRepo ProductRepository,
+	inboxRepo InboxRepository, quarantineRepo QuarantineRepository, sweepInterval time.Duration) SagaService {
 	return &SagaServiceImpl{
-		rdb:         rdb,
-		orderRepo:   orderRepo,
-		productRepo: productRepo,
+		bus:            bus,
+		orderService:   orderService,
+		orderRepo:      orderRepo,
+		productRepo:    productRepo,
+		inboxRepo:      inboxRepo,
+		quarantineRepo: quarantineRepo,
+		sweepInterval:  sweepInterval,
 	}
 }
 
-func (s *SagaServiceImpl) PublishEvent(event SagaEvent) {
-	eventJSON, _ := json.Marshal(event)
-	s.rdb.Publish(context.Background(), "saga_events", eventJSON)
+func (s *SagaServiceImpl) PublishEvent(event SagaEvent) error {
+	return s.bus.Publish(context.Background(), sagaEventsStream, event)
 }
 
+// ProcessEvents handles sales-service responses and acknowledges each one once it has been applied.
+// Messages that can never be applied are quarantined with the reason before they are acknowledged.
 func (s *SagaServiceImpl) ProcessEvents() {
-	pubsub := s.rdb.Subscribe(context.Background(), "saga_responses")
-	defer pubsub.Close()
+	ctx := context.Background()
+	for {
+		messages, err := s.bus.Subscribe(ctx, sagaResponsesStream, sagaConsumerGroup)
+		if err != nil {
+			log.Printf("Failed to subscribe to %s: %v", sagaResponsesStream, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
 
-	for msg := range pubsub.Channel() {
-		var event SagaEvent
-		json.Unmarshal([]byte(msg.Payload), &event)
+		for message := range messages {
+			event, err := decodeSagaEvent(message.Payload)
+			if err == nil {
+				err = s.handleEvent(event)
+			}
+			if errors.Is(err, ErrMalformedEvent) || errors.Is(err, ErrUnknownEventType) {
+				err = s.quarantineMessage(message, err)
+			}
+			if err != nil {
+				log.Printf("Failed to handle saga message %s, leaving it pending: %v", message.ID, err)
+				continue
+			}
+			if err := s.bus.Ack(ctx, message); err != nil {
+				log.Printf("Failed to acknowledge saga message %s: %v", message.ID, err)
+			}
+		}
+	}
+}
 
-		switch event.Type {
-		case "SALES_TRANSACTION_COMPLETED":
-			s.orderRepo.UpdateStatus(event.OrderID, "completed")
-		case "SALES_TRANSACTION_FAILED":
-			s.rollbackOrder(event.OrderID)
+// handleEvent applies a sales-service response to its order. Duplicates and errors that a redelivery
+// cannot fix are logged and swallowed so the message is acknowledged; anything else leaves it pending.
+func (s *SagaServiceImpl) handleEvent(event SagaEvent) error {
+	var err error
+	switch event.Type {
+	case events.TypeSalesTransactionCompleted, events.TypeSalesTransactionFailed:
+		err = s.orderService.ApplyEvent(event)
+	case events.TypeSalesTransactionVoided:
+		// Voids only follow a cancellation, so the order is already cancelled
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownEventType, event.Type)
+	}
+
+	if errors.Is(err, ErrDuplicateEvent) {
+		log.Printf("Skipping duplicate saga event %s (%s) for order %d", event.ID, event.Type, event.OrderID)
+		if err := s.inboxRepo.RecordDuplicate(event.ID); err != nil {
+			log.Printf("Failed to count duplicate saga event %s: %v", event.ID, err)
+		}
+		return nil
+	}
+
+	var transitionErr *InvalidTransitionError
+	if errors.As(err, &transitionErr) || errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrReservationExpired) {
+		log.Printf("Ignoring %s for order %d: %v", event.Type, event.OrderID, err)
+		return nil
+	}
+	return err
+}
+
+// SweepDeadlines periodically cancels orders that sales-service did not answer before their saga deadline
+func (s *SagaServiceImpl) SweepDeadlines() {
+	for {
+		orderIDs, err := s.orderRepo.ListSagaTimedOut(100)
+		if err != nil {
+			log.Printf("Failed to list timed out sagas: %v", err)
+		}
+
+		for _, orderID := range orderIDs {
+			if err := s.orderService.TimeoutSaga(orderID); err != nil {
+				log.Printf("Failed to time out saga for order %d: %v", orderID, err)
+			}
 		}
+
+		time.Sleep(s.sweepInterval)
 	}
 }
 
-func (s *SagaServiceImpl) rollbackOrder(orderID int) {
-	// Implementation for rollback logic
-	s.orderRepo.UpdateStatus(orderID, "cancelled")
+func (s *SagaServiceImpl) quarantineMessage(message BusMessage, reason error) error {
+	log.Printf("Quarantining saga message %s from %s: %v", message.ID, message.Topic, reason)
+	return s.quarantineRepo.Store(&QuarantinedMessage{
+		MessageID: message.ID,
+		Topic:     message.Topic,
+		// Postgres text cannot hold NUL bytes or invalid UTF-8
+		Payload: strings.ToValidUTF8(strings.ReplaceAll(string(message.Payload), "\x00", ""), "\uFFFD"),
+		Reason:  reason.Error(),
+	})
+}
+
+func (s *SagaServiceImpl) ListQuarantined(limit int) ([]QuarantinedMessage, error) {
+	return s.quarantineRepo.List(limit)
+}
+
+func (s *SagaServiceImpl) InboxStats() (*InboxStats, error) {
+	return s.inboxRepo.Stats()
+}
+
+// OutboxRetryPolicy decides when a failed outbox event is published again and when it is given up on
+type OutboxRetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Backoff doubles the delay with every attempt up to MaxDelay and randomises the upper half of it,
+// so events that failed together do not all retry at the same moment
+func (p OutboxRetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if attempt < 32 {
+		if d := p.BaseDelay << uint(attempt-1); d > 0 && d < p.MaxDelay {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
 }
 
 // OutboxServiceImpl implements OutboxService
 type OutboxServiceImpl struct {
 	outboxRepo  OutboxRepository
-	sagaService SagaService
+	bus         MessageBus
+	retryPolicy OutboxRetryPolicy
+	relayID     string
 }
 
-func NewOutboxService(outboxRepo OutboxRepository, sagaService SagaService) OutboxService {
+func NewOutboxService(outboxRepo OutboxRepository, bus MessageBus, retryPolicy OutboxRetryPolicy) OutboxService {
+	hostname, _ := os.Hostname()
 	return &OutboxServiceImpl{
 		outboxRepo:  outboxRepo,
-		sagaService: sagaService,
+		bus:         bus,
+		retryPolicy: retryPolicy,
+		relayID:     fmt.Sprintf("%s-%s", hostname, uuid.New().String()),
 	}
 }
 
+// ProcessEvents relays claimed outbox rows to the saga channel. Several replicas can run it at once
+// because each batch is leased to one relay, and a row is only marked processed after a confirmed publish.
 func (s *OutboxServiceImpl) ProcessEvents() {
 	for {
-		events, err := s.outboxRepo.GetUnprocessed()
+		claimed, err := s.outboxRepo.Claim(s.relayID, 30*time.Second, 100)
 		if err != nil {
+			log.Printf("Failed to claim outbox events: %v", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		for _, event := range events {
+		for _, event := range claimed {
+			payload, err := events.Default.Decode(event.EventType, event.DataVersion, event.EventData)
+			if err != nil {
+				// A row that does not match its schema will never publish, so it is not retried
+				log.Printf("Outbox event %s does not match its schema: %v", event.EventID, err)
+				if err := s.outboxRepo.DeadLetter(event.ID, s.relayID, err.Error()); err != nil {
+					log.Printf("Failed to dead-letter outbox event %s: %v", event.EventID, err)
+				}
+				continue
+			}
+
 			sagaEvent := SagaEvent{
 				ID:        event.EventID,
 				Type:      event.EventType,
 				OrderID:   event.AggregateID,
+				Data:      payload,
 				Timestamp: time.Now(),
 			}
+			if err := s.bus.Publish(context.Background(), sagaEventsStream, sagaEvent); err != nil {
+				log.Printf("Failed to publish outbox event %s (attempt %d): %v", event.EventID, event.Attempts, err)
+				s.handleFailure(event, err)
+				continue
+			}
 
-			json.Unmarshal(event.EventData, &sagaEvent.Data)
-			s.sagaService.PublishEvent(sagaEvent)
-			s.outboxRepo.MarkProcessed(event.ID)
+			if err := s.outboxRepo.MarkProcessed(event.ID, s.relayID); err != nil {
+				// The lease will run out and the event will be published again; consumers must tolerate duplicates
+				log.Printf("Failed to mark outbox event %s processed: %v", event.EventID, err)
+			}
 		}
 
 		time.Sleep(2 * time.Second)
 	}
-}
\ No newline at end of file
+}
+
+// handleFailure schedules the next attempt, or dead-letters the event once the policy's attempts are used up
+func (s *OutboxServiceImpl) handleFailure(event OutboxEvent, publishErr error) {
+	if event.Attempts >= s.retryPolicy.MaxAttempts {
+		if err := s.outboxRepo.DeadLetter(event.ID, s.relayID, publishErr.Error()); err != nil {
+			log.Printf("Failed to dead-letter outbox event %s: %v", event.EventID, err)
+			return
+		}
+		log.Printf("Outbox event %s moved to dead letters after %d attempts", event.EventID, event.Attempts)
+		return
+	}
+
+	nextAttemptAt := time.Now().Add(s.retryPolicy.Backoff(event.Attempts))
+	if err := s.outboxRepo.MarkFailed(event.ID, s.relayID, publishErr.Error(), nextAttemptAt); err != nil {
+		log.Printf("Failed to record outbox failure for %s: %v", event.EventID, err)
+	}
+}
+
+func (s *OutboxServiceImpl) ListDeadLetters(limit int) ([]DeadLetter, error) {
+	return s.outboxRepo.ListDeadLetters(limit)
+}
+
+func (s *OutboxServiceImpl) GetDeadLetter(id int) (*DeadLetter, error) {
+	return s.outboxRepo.GetDeadLetter(id)
+}
+
+func (s *OutboxServiceImpl) RedriveDeadLetter(id int) error {
+	return s.outboxRepo.Redrive(id)
+}
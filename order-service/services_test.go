@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// openTestDB connects to the orders database configured by DB_HOST and friends, as initDB does,
+// and skips the test when none is configured
+func openTestDB(t *testing.T) *sql.DB {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set; skipping test against Postgres")
+	}
+
+	testDB, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME")))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	if err := testDB.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	return testDB
+}
+
+// createTestProduct inserts a product with stock units and removes it, and every order placed for it, after the test
+func createTestProduct(t *testing.T, testDB *sql.DB, stock int) int {
+	var productID int
+	err := testDB.QueryRow("INSERT INTO products (name, price, stock_quantity) VALUES ($1, 10, $2) RETURNING id",
+		fmt.Sprintf("test product %d", time.Now().UnixNano()), stock).Scan(&productID)
+	if err != nil {
+		t.Fatalf("inserting product: %v", err)
+	}
+
+	t.Cleanup(func() {
+		var orderIDs []int64
+		rows, err := testDB.Query("SELECT DISTINCT order_id FROM order_items WHERE product_id = $1", productID)
+		if err == nil {
+			for rows.Next() {
+				var id int64
+				rows.Scan(&id)
+				orderIDs = append(orderIDs, id)
+			}
+			rows.Close()
+		}
+
+		ids := pq.Array(orderIDs)
+		for _, query := range []string{
+			"DELETE FROM outbox_events WHERE aggregate_id = ANY($1)",
+			"DELETE FROM reservations WHERE order_id = ANY($1)",
+			"DELETE FROM order_status_history WHERE order_id = ANY($1)",
+			"DELETE FROM order_items WHERE order_id = ANY($1)",
+			"DELETE FROM orders WHERE id = ANY($1)",
+		} {
+			if _, err := testDB.Exec(query, ids); err != nil {
+				t.Logf("cleanup %q: %v", query, err)
+			}
+		}
+		testDB.Exec("DELETE FROM outbox_events WHERE aggregate_id = $1", productID)
+		testDB.Exec("DELETE FROM products WHERE id = $1", productID)
+	})
+	return productID
+}
+
+func newTestOrderService(testDB *sql.DB) OrderService {
+	return NewOrderService(NewOrderRepository(testDB), NewProductRepository(testDB), NewOutboxRepository(testDB),
+		NewReservationRepository(testDB), NewIdempotencyRepository(testDB), NewInboxRepository(testDB),
+		15*time.Minute, 5*time.Minute, testDB)
+}
+
+// Concurrent orders for the last units of a product must not oversell it
+func TestCreateOrderDoesNotOversell(t *testing.T) {
+	testDB := openTestDB(t)
+	const stock, buyers = 5, 20
+	productID := createTestProduct(t, testDB, stock)
+	service := newTestOrderService(testDB)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(customerID int) {
+			defer wg.Done()
+			_, err := service.CreateOrder(&Order{CustomerID: customerID, Items: []OrderItem{{ProductID: productID, Quantity: 1}}}, nil)
+			switch {
+			case err == nil:
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			case !errors.Is(err, ErrInsufficientStock):
+				t.Errorf("CreateOrder for customer %d: %v", customerID, err)
+			}
+		}(i + 1)
+	}
+	wg.Wait()
+
+	if succeeded != stock {
+		t.Errorf("%d orders succeeded, want %d", succeeded, stock)
+	}
+
+	var available, reserved int
+	err := testDB.QueryRow("SELECT stock_quantity - reserved_quantity, reserved_quantity FROM products WHERE id = $1", productID).
+		Scan(&available, &reserved)
+	if err != nil {
+		t.Fatalf("loading product: %v", err)
+	}
+	if available < 0 {
+		t.Errorf("stock_quantity - reserved_quantity is %d", available)
+	}
+	if reserved != succeeded {
+		t.Errorf("reserved_quantity is %d, want one unit per successful order (%d)", reserved, succeeded)
+	}
+}
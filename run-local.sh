@@ -17,6 +17,7 @@ sleep 3
 echo "Creating databases..."
 createdb orders 2>/dev/null || true
 createdb sales 2>/dev/null || true
+createdb orchestrator 2>/dev/null || true
 
 # Run init script
 echo "Initializing databases..."
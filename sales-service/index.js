@@ -1,5 +1,6 @@
 require('dotenv').config();
 
+const os = require('os');
 const express = require('express');
 const { Pool } = require('pg');
 const redis = require('redis');
@@ -28,6 +29,7 @@ redisClient.connect();
 app.get('/vouchers', getVouchers);
 app.post('/vouchers', createVoucher);
 app.post('/sales/process', processSalesTransaction);
+app.post('/sales/:id/void', voidSalesTransaction);
 app.get('/sales/:orderId', getSalesTransaction);
 
 // Saga event processing
@@ -64,10 +66,16 @@ async function createVoucher(req, res) {
 
 async function processSalesTransaction(req, res) {
   const { order_id, customer_id, original_amount, voucher_code } = req.body;
+  // A retried request with the same key gets the transaction the first attempt created instead of a second charge
+  const idempotencyKey = req.get('Idempotency-Key') || null;
   
   const client = await pool.connect();
   
   try {
+    if (idempotencyKey && await replayTransaction(client, res, idempotencyKey, order_id)) {
+      return;
+    }
+    
     await client.query('BEGIN');
     
     let discount_amount = 0;
@@ -96,9 +104,9 @@ async function processSalesTransaction(req, res) {
     // Create sales transaction
     const result = await client.query(
       `INSERT INTO sales_transactions 
-       (order_id, customer_id, voucher_id, original_amount, discount_amount, final_amount, status) 
-       VALUES ($1, $2, $3, $4, $5, $6, 'completed') RETURNING *`,
-      [order_id, customer_id, voucher_id, original_amount, discount_amount, final_amount]
+       (order_id, customer_id, voucher_id, original_amount, discount_amount, final_amount, status, idempotency_key) 
+       VALUES ($1, $2, $3, $4, $5, $6, 'completed', $7) RETURNING *`,
+      [order_id, customer_id, voucher_id, original_amount, discount_amount, final_amount, idempotencyKey]
     );
     
     // Store event in outbox within same transaction
@@ -126,6 +134,11 @@ async function processSalesTransaction(req, res) {
   } catch (error) {
     await client.query('ROLLBACK');
     
+    // The unique key was taken between our lookup and the insert; answer with the winner's transaction
+    if (idempotencyKey && error.code === '23505' && await replayTransaction(client, res, idempotencyKey, order_id)) {
+      return;
+    }
+    
     // Store failure event in outbox (separate transaction)
     const failureClient = await pool.connect();
     try {
@@ -151,17 +164,111 @@ async function processSalesTransaction(req, res) {
   }
 }
 
+// Answers with the transaction already created under idempotencyKey and reports whether there was one
+async function replayTransaction(client, res, idempotencyKey, orderId) {
+  const existing = await client.query(
+    'SELECT * FROM sales_transactions WHERE idempotency_key = $1',
+    [idempotencyKey]
+  );
+  if (existing.rows.length === 0) {
+    return false;
+  }
+  
+  if (existing.rows[0].order_id !== orderId) {
+    res.status(422).json({ error: 'Idempotency-Key was already used with a different request' });
+    return true;
+  }
+  
+  res.set('Idempotent-Replayed', 'true');
+  res.json(existing.rows[0]);
+  return true;
+}
+
+async function voidSalesTransaction(req, res) {
+  const { id } = req.params;
+  const { reason } = req.body || {};
+  
+  const client = await pool.connect();
+  
+  try {
+    await client.query('BEGIN');
+    
+    const existing = await client.query(
+      'SELECT * FROM sales_transactions WHERE id = $1 FOR UPDATE',
+      [id]
+    );
+    
+    if (existing.rows.length === 0) {
+      await client.query('ROLLBACK');
+      return res.status(404).json({ error: 'Sales transaction not found' });
+    }
+    
+    // Voiding twice is a no-op so saga compensation can be retried safely
+    if (existing.rows[0].status === 'voided') {
+      await client.query('ROLLBACK');
+      return res.json(existing.rows[0]);
+    }
+    
+    const transaction = await voidTransaction(client, id, reason);
+    
+    await client.query('COMMIT');
+    
+    res.json(transaction);
+    
+  } catch (error) {
+    await client.query('ROLLBACK');
+    res.status(500).json({ error: error.message });
+  } finally {
+    client.release();
+  }
+}
+
+// Marks a locked transaction voided and records SALES_TRANSACTION_VOIDED in the outbox, inside the caller's transaction
+async function voidTransaction(client, id, reason) {
+  const result = await client.query(
+    `UPDATE sales_transactions SET status = 'voided', voided_at = CURRENT_TIMESTAMP, void_reason = $2
+     WHERE id = $1 RETURNING *`,
+    [id, reason || null]
+  );
+  
+  const transaction = result.rows[0];
+  const sagaEvent = {
+    id: uuidv4(),
+    type: 'SALES_TRANSACTION_VOIDED',
+    order_id: transaction.order_id,
+    data: {
+      transaction_id: transaction.id,
+      final_amount: transaction.final_amount,
+      voucher_id: transaction.voucher_id
+    },
+    timestamp: new Date()
+  };
+  
+  await client.query(
+    'INSERT INTO outbox_events (event_id, event_type, aggregate_id, event_data) VALUES ($1, $2, $3, $4)',
+    [sagaEvent.id, sagaEvent.type, transaction.order_id, JSON.stringify(sagaEvent.data)]
+  );
+  
+  return transaction;
+}
+
 async function getSalesTransaction(req, res) {
   const { orderId } = req.params;
+  const idempotencyKey = req.query.idempotency_key;
   
   try {
-    const result = await pool.query(
-      `SELECT st.*, v.code as voucher_code 
+    // With idempotency_key only the transaction that request created matches
+    let query = `SELECT st.*, v.code as voucher_code 
        FROM sales_transactions st 
        LEFT JOIN vouchers v ON st.voucher_id = v.id 
-       WHERE st.order_id = $1`,
-      [orderId]
-    );
+       WHERE st.order_id = $1`;
+    const params = [orderId];
+    if (idempotencyKey) {
+      query += ' AND st.idempotency_key = $2';
+      params.push(idempotencyKey);
+    }
+    
+    const result = await pool.query(query, params);
     
     if (result.rows.length === 0) {
       return res.status(404).json({ error: 'Sales transaction not found' });
@@ -173,27 +280,91 @@ async function getSalesTransaction(req, res) {
   }
 }
 
+const SAGA_EVENTS_STREAM = 'saga_events';
+const SAGA_RESPONSES_STREAM = 'saga_responses';
+const SAGA_CONSUMER_GROUP = 'sales-service';
+const SAGA_CONSUMER_NAME = `${os.hostname()}-${uuidv4()}`;
+// Envelope version expected by order-service, which rejects any other
+const SAGA_EVENT_VERSION = 1;
+const SAGA_STREAM_MAXLEN = parseInt(process.env.SAGA_STREAM_MAXLEN || '10000', 10);
+const SAGA_STREAM_CLAIM_MIN_IDLE_MS = parseInt(process.env.SAGA_STREAM_CLAIM_MIN_IDLE_MS || '60000', 10);
+
 async function publishSagaEvent(event) {
-  await redisClient.publish('saga_responses', JSON.stringify(event));
+  await redisClient.xAdd(SAGA_RESPONSES_STREAM, '*', { event: JSON.stringify(event) }, {
+    TRIM: { strategy: 'MAXLEN', strategyModifier: '~', threshold: SAGA_STREAM_MAXLEN }
+  });
+}
+
+async function handleSagaMessage(message) {
+  let event;
+  try {
+    event = JSON.parse(message.message.event);
+  } catch (error) {
+    // A malformed entry will never parse, so it is acknowledged rather than retried forever
+    console.error(`Dropping undecodable saga message ${message.id}:`, error);
+  }
+
+  if (event) {
+    switch (event.type) {
+      case 'ORDER_CREATED':
+        await handleOrderCreated(event);
+        break;
+      case 'ORDER_CANCELLED':
+        await handleOrderCancelled(event);
+        break;
+    }
+  }
+
+  await redisClient.xAck(SAGA_EVENTS_STREAM, SAGA_CONSUMER_GROUP, message.id);
+}
+
+async function deliverSagaMessages(messages) {
+  for (const message of messages) {
+    // Entries deleted from the stream while pending come back empty
+    if (!message) continue;
+    try {
+      await handleSagaMessage(message);
+    } catch (error) {
+      console.error(`Error processing saga message ${message.id}, leaving it pending:`, error);
+    }
+  }
 }
 
 async function processSagaEvents() {
-  const subscriber = redisClient.duplicate();
-  await subscriber.connect();
-  
-  await subscriber.subscribe('saga_events', async (message) => {
+  // Blocking reads need their own connection
+  const consumer = redisClient.duplicate();
+  await consumer.connect();
+
+  try {
+    await consumer.xGroupCreate(SAGA_EVENTS_STREAM, SAGA_CONSUMER_GROUP, '$', { MKSTREAM: true });
+  } catch (error) {
+    if (!error.message.startsWith('BUSYGROUP')) throw error;
+  }
+
+  let claimCursor = '0-0';
+  while (true) {
     try {
-      const event = JSON.parse(message);
-      
-      switch (event.type) {
-        case 'ORDER_CREATED':
-          await handleOrderCreated(event);
-          break;
+      // Take over entries a crashed consumer read but never acknowledged
+      const claimed = await consumer.xAutoClaim(
+        SAGA_EVENTS_STREAM, SAGA_CONSUMER_GROUP, SAGA_CONSUMER_NAME,
+        SAGA_STREAM_CLAIM_MIN_IDLE_MS, claimCursor, { COUNT: 50 }
+      );
+      claimCursor = claimed.nextId;
+      await deliverSagaMessages(claimed.messages);
+
+      const streams = await consumer.xReadGroup(
+        SAGA_CONSUMER_GROUP, SAGA_CONSUMER_NAME,
+        { key: SAGA_EVENTS_STREAM, id: '>' },
+        { COUNT: 50, BLOCK: 5000 }
+      );
+      for (const stream of streams || []) {
+        await deliverSagaMessages(stream.messages);
       }
     } catch (error) {
-      console.error('Error processing saga event:', error);
+      console.error('Error reading saga events:', error);
+      await new Promise((resolve) => setTimeout(resolve, 1000));
     }
-  });
+  }
 }
 
 async function handleOrderCreated(event) {
@@ -206,14 +377,23 @@ async function handleOrderCreated(event) {
     try {
       await client.query('BEGIN');
       
-      // Create sales transaction without voucher (can be updated later)
+      // Create sales transaction without voucher (can be updated later). The event id is the idempotency key,
+      // so a redelivered ORDER_CREATED finds the charge its first delivery made instead of charging again
       const result = await client.query(
         `INSERT INTO sales_transactions 
-         (order_id, customer_id, original_amount, discount_amount, final_amount, status) 
-         VALUES ($1, $2, $3, 0, $3, 'pending') RETURNING *`,
-        [event.order_id, customer_id, total_amount]
+         (order_id, customer_id, original_amount, discount_amount, final_amount, status, idempotency_key) 
+         VALUES ($1, $2, $3, 0, $3, 'pending', $4)
+         ON CONFLICT (idempotency_key) DO NOTHING RETURNING *`,
+        [event.order_id, customer_id, total_amount, event.id]
       );
       
+      // The first delivery already stored its outcome in the outbox
+      if (result.rows.length === 0) {
+        await client.query('COMMIT');
+        console.log(`ORDER_CREATED ${event.id} for order ${event.order_id} was already charged, skipping`);
+        return;
+      }
+      
       // Store success event in outbox within same transaction
       const sagaEvent = {
         id: uuidv4(),
@@ -261,6 +441,33 @@ async function handleOrderCreated(event) {
     
   } catch (error) {
     console.error('Error handling order created event:', error);
+    throw error;
+  }
+}
+
+// The choreography saga cancelled the order (payment failure, timeout or a late payment),
+// so every charge still standing for it is voided
+async function handleOrderCancelled(event) {
+  const client = await pool.connect();
+  
+  try {
+    await client.query('BEGIN');
+    
+    const existing = await client.query(
+      `SELECT id FROM sales_transactions WHERE order_id = $1 AND status <> 'voided' ORDER BY id FOR UPDATE`,
+      [event.order_id]
+    );
+    
+    for (const row of existing.rows) {
+      await voidTransaction(client, row.id, `order cancelled: ${event.data.reason}`);
+    }
+    
+    await client.query('COMMIT');
+  } catch (error) {
+    await client.query('ROLLBACK');
+    throw error;
+  } finally {
+    client.release();
   }
 }
 
@@ -273,6 +480,7 @@ async function processOutboxEvents() {
       
       for (const row of result.rows) {
         const sagaEvent = {
+          version: SAGA_EVENT_VERSION,
           id: row.event_id,
           type: row.event_type,
           order_id: row.aggregate_id,
@@ -24,6 +24,7 @@ sleep 3
 echo "Creating databases..."
 createdb orders 2>/dev/null || echo "Database 'orders' already exists"
 createdb sales 2>/dev/null || echo "Database 'sales' already exists"
+createdb orchestrator 2>/dev/null || echo "Database 'orchestrator' already exists"
 
 # Initialize databases
 echo "Initializing databases..."